@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// liveAgent is a connection to an ssh-agent that is held for the life of the process.
+// Its keys are listed anew for each connection attempt, so that keys added to the agent
+// later on are used when re-connecting.
+type liveAgent struct {
+	addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// agentKey is a key held by an ssh-agent.
+type agentKey struct {
+	ssh.Signer
+	Comment string
+}
+
+var (
+	liveAgentsMu sync.Mutex
+	liveAgents   = make(map[string]*liveAgent)
+)
+
+// openAgent returns the (shared) agent connection for the given socket address.
+// The connection is only established once the agent is first used.
+func openAgent(addr string) *liveAgent {
+	liveAgentsMu.Lock()
+	defer liveAgentsMu.Unlock()
+	if a, ok := liveAgents[addr]; ok {
+		return a
+	}
+	a := &liveAgent{addr: addr}
+	liveAgents[addr] = a
+	state.cleanup = append(state.cleanup, a.Close)
+	return a
+}
+
+// Keys lists the agent's keys. If the connection to the agent has been lost, it is re-established.
+func (a *liveAgent) Keys() ([]agentKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys, err := a.keys()
+	if err != nil && a.conn != nil {
+		a.close()
+		keys, err = a.keys()
+	}
+	if err != nil {
+		a.close()
+		return nil, fmt.Errorf("ssh-agent %s: %v", a.addr, err)
+	}
+	return keys, nil
+}
+
+func (a *liveAgent) keys() ([]agentKey, error) {
+	if a.conn == nil {
+		conn, err := net.Dial("unix", a.addr)
+		if err != nil {
+			return nil, err
+		}
+		a.conn = conn
+		a.client = agent.NewClient(conn)
+	}
+	listed, err := a.client.List()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := a.client.Signers()
+	if err != nil {
+		return nil, err
+	}
+	comments := make(map[string]string)
+	for _, key := range listed {
+		comments[string(key.Marshal())] = key.Comment
+	}
+	keys := make([]agentKey, len(signers))
+	for i, signer := range signers {
+		keys[i] = agentKey{Signer: signer, Comment: comments[string(signer.PublicKey().Marshal())]}
+	}
+	return keys, nil
+}
+
+// Client returns the agent client, connecting if necessary.
+func (a *liveAgent) Client() (agent.ExtendedAgent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		conn, err := net.Dial("unix", a.addr)
+		if err != nil {
+			return nil, fmt.Errorf("ssh-agent %s: %v", a.addr, err)
+		}
+		a.conn = conn
+		a.client = agent.NewClient(conn)
+	}
+	return a.client, nil
+}
+
+// Close closes the agent connection.
+func (a *liveAgent) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.close()
+}
+
+func (a *liveAgent) close() {
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+		a.client = nil
+	}
+}
+
+// agentKeySelector selects agent keys by fingerprint (SHA256:... or MD5:...), public key file, or comment.
+type agentKeySelector []string
+
+// Matches returns whether the given key is selected. Certificates are selected by their key.
+func (s agentKeySelector) Matches(key agentKey) bool {
+	publicKey := key.PublicKey()
+	if cert, ok := asCertificate(publicKey); ok {
+		publicKey = cert.Key
+	}
+	for _, selector := range s {
+		switch {
+		case strings.HasPrefix(selector, "SHA256:"):
+			if selector == ssh.FingerprintSHA256(publicKey) {
+				return true
+			}
+		case strings.HasPrefix(selector, "MD5:"):
+			if strings.EqualFold(strings.TrimPrefix(selector, "MD5:"), ssh.FingerprintLegacyMD5(publicKey)) {
+				return true
+			}
+		default:
+			if _, err := os.Stat(selector); err == nil {
+				fileKey, err := readPublicKeyFile(selector)
+				if cert, ok := fileKey.(*ssh.Certificate); ok {
+					fileKey = cert.Key
+				}
+				if err == nil && string(fileKey.Marshal()) == string(publicKey.Marshal()) {
+					return true
+				}
+				continue
+			}
+			if selector == key.Comment {
+				return true
+			}
+		}
+	}
+	return false
+}
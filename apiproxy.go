@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgreben/sshtunnel/connpipe"
+)
+
+// maxAPIBodySize is the maximum size of the JSON request and response bodies that are read for
+// inspection. Other bodies (such as build contexts and streamed output) are passed through unread.
+const maxAPIBodySize = 1 << 20
+
+// apiVersionPrefix matches the API version prefix of Docker API paths (e.g. /v1.41/), as routed by the daemon.
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// apiHook inspects (and may rewrite) the Docker API requests and responses passing through the tunnel.
+type apiHook interface {
+	// Request is called before the request is forwarded. If it returns an error,
+	// the request is not forwarded, and the error is returned to the client instead.
+	Request(ctx context.Context, req *apiRequest) error
+	// Response is called before the response is returned to the client. If it returns an error,
+	// the error is returned to the client instead.
+	Response(ctx context.Context, req *apiRequest, resp *apiResponse) error
+}
+
+// apiObserver is implemented by hooks that are notified of the outcome of each request.
+type apiObserver interface {
+	// Hijacked is called when the connection is hijacked, before the raw stream is passed through.
+	Hijacked(x *apiExchange)
+	// Done is called once the request has been handled: after the response (or an error) has been
+	// written to the client, or after the hijacked connection has been closed.
+	Done(x *apiExchange)
+}
+
+// apiExchange is a Docker API request and its outcome.
+type apiExchange struct {
+	Request *apiRequest
+	// Start is when the request was read.
+	Start time.Time
+	// StatusCode is the status of the response written to the client, or 0 if none was written.
+	StatusCode int
+	// Err is the error returned to the client instead of the daemon's response (or that ended the connection), if any.
+	Err error
+	// Hijacked is set if the connection was hijacked.
+	Hijacked bool
+	// BytesIn and BytesOut count the body bytes read from and written to the client, including
+	// the raw stream of a hijacked connection. They are updated atomically.
+	BytesIn, BytesOut int64
+}
+
+// apiRequest is a Docker API request.
+type apiRequest struct {
+	*http.Request
+	// Client is the local client connection.
+	Client net.Conn
+	// Path is the cleaned URL path without the API version prefix (e.g. /containers/create).
+	Path string
+	// JSON is the request body if it is JSON of at most maxAPIBodySize bytes, or else nil.
+	// Hooks may replace it.
+	JSON []byte
+	// Values are set by hooks when handling the request, for use when handling the response.
+	Values map[string]interface{}
+}
+
+// apiResponse is a Docker API response.
+type apiResponse struct {
+	*http.Response
+	// JSON is the response body if it is JSON of at most maxAPIBodySize bytes, or else nil.
+	// Hooks may replace it.
+	JSON []byte
+}
+
+// apiError is an error response to a Docker API request, in the format of the Docker daemon.
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// serveAPIProxy serves connections on the listener like serveTunnel, but reads the Docker API
+// requests and responses, passing them through the given hooks. Once a connection is hijacked
+// (by attach and exec), it is passed through unchanged.
+func serveAPIProxy(ctx context.Context, listener net.Listener, dial func(context.Context) (net.Conn, error), hooks []apiHook) {
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveAPIConn(ctx, conn, dial, hooks)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+}
+
+// serveAPIConn serves the requests of a client connection, forwarding them over a tunnelled
+// connection that is opened on the first forwarded request.
+func serveAPIConn(ctx context.Context, clientConn net.Conn, dial func(context.Context) (net.Conn, error), hooks []apiHook) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer clientConn.Close()
+	client := bufio.NewReader(clientConn)
+	var tunnelConn net.Conn
+	var tunnel *bufio.Reader
+	defer func() {
+		if tunnelConn != nil {
+			tunnelConn.Close()
+		}
+	}()
+	for {
+		httpReq, err := http.ReadRequest(client)
+		if err != nil {
+			return
+		}
+		x := &apiExchange{Start: time.Now()}
+		httpReq.Body = &countingReadCloser{ReadCloser: httpReq.Body, n: &x.BytesIn}
+		req, err := readAPIRequest(httpReq, clientConn)
+		if err != nil {
+			return
+		}
+		x.Request = req
+		done := func(err error) {
+			x.Err = err
+			observeDone(hooks, x)
+		}
+		fail := func(err error) error {
+			x.StatusCode = asAPIError(err).StatusCode
+			errWrite := writeAPIError(clientConn, httpReq, err)
+			done(err)
+			return errWrite
+		}
+		if err := apiRequestHooks(ctx, hooks, req); err != nil {
+			io.Copy(ioutil.Discard, httpReq.Body)
+			if fail(err) != nil || httpReq.Close {
+				return
+			}
+			continue
+		}
+		if tunnelConn == nil {
+			if tunnelConn, err = dial(ctx); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("tunnel: %v", err)
+				}
+				fail(&apiError{StatusCode: http.StatusBadGateway, Message: fmt.Sprintf("tunnel: %v", err)})
+				return
+			}
+			tunnel = bufio.NewReader(tunnelConn)
+		}
+		if err := httpReq.Write(tunnelConn); err != nil {
+			done(err)
+			return
+		}
+		httpResp, err := http.ReadResponse(tunnel, httpReq)
+		if err != nil {
+			done(err)
+			return
+		}
+		if isHijacked(httpReq, httpResp) {
+			if err := apiResponseHooks(ctx, hooks, req, &apiResponse{Response: httpResp}); err != nil {
+				fail(err)
+				return
+			}
+			if err := writeResponseHeader(clientConn, httpResp); err != nil {
+				done(err)
+				return
+			}
+			x.StatusCode = httpResp.StatusCode
+			x.Hijacked = true
+			observeHijacked(hooks, x)
+			clientStream := &countingConn{Conn: &bufferedConn{Conn: clientConn, reader: client}, in: &x.BytesIn, out: &x.BytesOut}
+			connpipe.Run(ctx, &bufferedConn{Conn: tunnelConn, reader: tunnel}, clientStream)
+			done(nil)
+			return
+		}
+		resp, err := readAPIResponse(req, httpResp, tunnel)
+		if err != nil {
+			done(err)
+			return
+		}
+		if err := apiResponseHooks(ctx, hooks, req, resp); err != nil {
+			httpResp.Body.Close()
+			fail(err)
+			return
+		}
+		x.StatusCode = httpResp.StatusCode
+		body := httpResp.Body
+		httpResp.Body = &countingReadCloser{ReadCloser: body, n: &x.BytesOut}
+		err = httpResp.Write(clientConn)
+		body.Close()
+		done(err)
+		if err != nil || httpReq.Close || httpResp.Close {
+			return
+		}
+	}
+}
+
+func observeHijacked(hooks []apiHook, x *apiExchange) {
+	for _, hook := range hooks {
+		if observer, ok := hook.(apiObserver); ok {
+			observer.Hijacked(x)
+		}
+	}
+}
+
+func observeDone(hooks []apiHook, x *apiExchange) {
+	for _, hook := range hooks {
+		if observer, ok := hook.(apiObserver); ok {
+			observer.Done(x)
+		}
+	}
+}
+
+func apiRequestHooks(ctx context.Context, hooks []apiHook, req *apiRequest) error {
+	for _, hook := range hooks {
+		if err := hook.Request(ctx, req); err != nil {
+			return err
+		}
+	}
+	if req.JSON != nil {
+		req.Request.Body = ioutil.NopCloser(bytes.NewReader(req.JSON))
+		req.Request.ContentLength = int64(len(req.JSON))
+		req.Request.TransferEncoding = nil
+	}
+	return nil
+}
+
+func apiResponseHooks(ctx context.Context, hooks []apiHook, req *apiRequest, resp *apiResponse) error {
+	for _, hook := range hooks {
+		if err := hook.Response(ctx, req, resp); err != nil {
+			return err
+		}
+	}
+	if resp.JSON != nil {
+		resp.Response.Body = ioutil.NopCloser(bytes.NewReader(resp.JSON))
+		resp.Response.ContentLength = int64(len(resp.JSON))
+		resp.Response.TransferEncoding = nil
+	}
+	return nil
+}
+
+// readAPIRequest reads the body of the given request if it is JSON of at most maxAPIBodySize bytes.
+// Bodies of unknown length (chunked) are read up to that size.
+func readAPIRequest(httpReq *http.Request, client net.Conn) (*apiRequest, error) {
+	req := &apiRequest{
+		Request: httpReq,
+		Client:  client,
+		Path:    apiVersionPrefix.ReplaceAllString(path.Clean(httpReq.URL.Path), "/"),
+		Values:  make(map[string]interface{}),
+	}
+	contentLength := httpReq.ContentLength
+	if contentLength < 0 {
+		contentLength = 1
+	}
+	if isJSON(httpReq.Header, contentLength) {
+		buf, err := ioutil.ReadAll(io.LimitReader(httpReq.Body, maxAPIBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > maxAPIBodySize {
+			httpReq.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), httpReq.Body), httpReq.Body}
+			return req, nil
+		}
+		req.JSON = buf
+	}
+	return req, nil
+}
+
+// readAPIResponse reads the body of the given response (read from tunnel) if it is JSON of at most
+// maxAPIBodySize bytes. Like request bodies, response bodies of unknown length (chunked, as the daemon
+// sends larger JSON responses) are read up to that size, unless the response may be a stream: the
+// headers are then forwarded without waiting for the body.
+func readAPIResponse(req *apiRequest, httpResp *http.Response, tunnel *bufio.Reader) (*apiResponse, error) {
+	resp := &apiResponse{Response: httpResp}
+	contentLength := httpResp.ContentLength
+	if contentLength < 0 && !isStreamed(req, tunnel) {
+		contentLength = 1
+	}
+	if isJSON(httpResp.Header, contentLength) {
+		buf, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxAPIBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > maxAPIBodySize {
+			httpResp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), httpResp.Body), httpResp.Body}
+			return resp, nil
+		}
+		resp.JSON = buf
+	}
+	return resp, nil
+}
+
+// isStreamed returns whether the response to the given request may be a stream of JSON messages
+// (events, stats or progress) for as long as the operation runs, or a body that is only sent when
+// the operation ends (wait), which must not be waited for. Stats are only streamed if not requested
+// with stream=false. Any other response whose body has not arrived with its headers is treated the same.
+func isStreamed(req *apiRequest, tunnel *bufio.Reader) bool {
+	switch {
+	case tunnel.Buffered() == 0:
+		return true
+	case req.Path == "/events", req.Path == "/build", req.Path == "/images/create", req.Path == "/images/load", req.Path == "/plugins/pull":
+		return true
+	case matchPath("/containers/*/wait", req.Path):
+		return true
+	case strings.HasPrefix(req.Path, "/images/") && strings.HasSuffix(req.Path, "/push"):
+		return true
+	case strings.HasPrefix(req.Path, "/plugins/") && (strings.HasSuffix(req.Path, "/push") || strings.HasSuffix(req.Path, "/upgrade")):
+		return true
+	case matchPath("/containers/*/stats", req.Path):
+		stream, err := strconv.ParseBool(req.URL.Query().Get("stream"))
+		return err != nil || stream
+	}
+	return false
+}
+
+// isJSON returns whether a body with the given headers and length is JSON to be read for inspection.
+// Bodies of unknown length (contentLength < 0) are not.
+func isJSON(header http.Header, contentLength int64) bool {
+	if contentLength <= 0 || contentLength > maxAPIBodySize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// isHijacked returns whether the connection is taken over by a raw stream after the response,
+// as it is for attach and exec: either the connection was upgraded, or (for older daemons)
+// an upgrade was requested, and the response is a raw stream.
+func isHijacked(httpReq *http.Request, httpResp *http.Response) bool {
+	if httpResp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	if httpReq.Header.Get("Upgrade") == "" || httpResp.StatusCode != http.StatusOK {
+		return false
+	}
+	switch httpResp.Header.Get("Content-Type") {
+	case "application/vnd.docker.raw-stream", "application/vnd.docker.multiplexed-stream":
+		return true
+	}
+	return false
+}
+
+// writeResponseHeader writes the status line and headers of the given response.
+func writeResponseHeader(w io.Writer, httpResp *http.Response) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/%d.%d %s\r\n", httpResp.ProtoMajor, httpResp.ProtoMinor, httpResp.Status)
+	httpResp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// asAPIError returns the given error as an *apiError. Other errors are 500 Internal Server Error.
+func asAPIError(err error) *apiError {
+	if e, ok := err.(*apiError); ok {
+		return e
+	}
+	return &apiError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+}
+
+// writeAPIError writes an error response to the given request.
+func writeAPIError(w io.Writer, httpReq *http.Request, err error) error {
+	e := asAPIError(err)
+	body, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{e.Message})
+	body = append(body, '\n')
+	httpResp := &http.Response{
+		StatusCode:    e.StatusCode,
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       httpReq,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         httpReq.Close,
+	}
+	return httpResp.Write(w)
+}
+
+// countingReadCloser counts the bytes read (atomically) in n.
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// countingConn counts the bytes read from and written to the connection (atomically) in in and out.
+type countingConn struct {
+	net.Conn
+	in, out *int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
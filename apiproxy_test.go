@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAPIResponse(t *testing.T) {
+	small := `[{"Id":"abc"}]`
+	large := `"` + strings.Repeat("x", maxAPIBodySize) + `"`
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		chunked     bool
+		wantJSON    bool
+	}{
+		{name: "json", target: "/v1.41/containers/json", contentType: "application/json", body: small, wantJSON: true},
+		{name: "chunked json", target: "/v1.41/containers/json", contentType: "application/json", body: small, chunked: true, wantJSON: true},
+		{name: "json with charset", target: "/v1.41/containers/json", contentType: "application/json; charset=utf-8", body: small, chunked: true, wantJSON: true},
+		{name: "large json", target: "/v1.41/containers/json", contentType: "application/json", body: large},
+		{name: "large chunked json", target: "/v1.41/containers/json", contentType: "application/json", body: large, chunked: true},
+		{name: "text", target: "/v1.41/containers/abc/logs", contentType: "text/plain", body: small, chunked: true},
+		{name: "events", target: "/v1.41/events", contentType: "application/json", body: small, chunked: true},
+		{name: "pull", target: "/v1.41/images/create?fromImage=alpine", contentType: "application/json", body: small, chunked: true},
+		{name: "push", target: "/v1.41/images/registry.example.com/app/push", contentType: "application/json", body: small, chunked: true},
+		{name: "stats", target: "/v1.41/containers/abc/stats", contentType: "application/json", body: small, chunked: true},
+		{name: "wait", target: "/v1.41/containers/abc/wait", contentType: "application/json", body: small, chunked: true},
+		{name: "stats without stream", target: "/v1.41/containers/abc/stats?stream=false", contentType: "application/json", body: small, chunked: true, wantJSON: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw bytes.Buffer
+			fmt.Fprintf(&raw, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\n", tt.contentType)
+			if tt.chunked {
+				raw.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+				chunked := httputil.NewChunkedWriter(&raw)
+				chunked.Write([]byte(tt.body))
+				chunked.Close()
+				raw.WriteString("\r\n")
+			} else {
+				fmt.Fprintf(&raw, "Content-Length: %d\r\n\r\n%s", len(tt.body), tt.body)
+			}
+			req := testAPIRequest(t, "GET", tt.target, "")
+			tunnel := bufio.NewReader(&raw)
+			httpResp, err := http.ReadResponse(tunnel, req.Request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := readAPIResponse(req, httpResp, tunnel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantJSON {
+				if string(resp.JSON) != tt.body {
+					t.Errorf("JSON = %q, want %q", resp.JSON, tt.body)
+				}
+				return
+			}
+			if resp.JSON != nil {
+				t.Fatalf("JSON = %q, want nil", resp.JSON)
+			}
+			body, err := ioutil.ReadAll(httpResp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body has %d bytes, want the %d bytes sent", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+// TestServeAPIConnDelayedBody checks that the headers of responses whose body is sent later
+// (as for /containers/{id}/wait, which the client waits for before starting the container) are
+// forwarded without waiting for the body.
+func TestServeAPIConnDelayedBody(t *testing.T) {
+	for _, target := range []string{"/v1.41/containers/abc/wait", "/v1.41/containers/abc/json"} {
+		t.Run(target, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			release := make(chan struct{})
+			dial := func(ctx context.Context) (net.Conn, error) {
+				tunnelConn, daemonConn := net.Pipe()
+				go func() {
+					defer daemonConn.Close()
+					req, err := http.ReadRequest(bufio.NewReader(daemonConn))
+					if err != nil {
+						return
+					}
+					io.Copy(ioutil.Discard, req.Body)
+					io.WriteString(daemonConn, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n")
+					<-release
+					chunked := httputil.NewChunkedWriter(daemonConn)
+					io.WriteString(chunked, `{"StatusCode":0}`)
+					chunked.Close()
+					io.WriteString(daemonConn, "\r\n")
+				}()
+				return tunnelConn, nil
+			}
+			clientConn, proxyConn := net.Pipe()
+			defer clientConn.Close()
+			go serveAPIConn(ctx, proxyConn, dial, nil)
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			httpReq := httptest.NewRequest("POST", target, nil)
+			if err := httpReq.Write(clientConn); err != nil {
+				t.Fatal(err)
+			}
+			httpResp, err := http.ReadResponse(bufio.NewReader(clientConn), httpReq)
+			if err != nil {
+				t.Fatalf("read response headers before the body is sent: %v", err)
+			}
+			close(release)
+			body, err := ioutil.ReadAll(httpResp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != `{"StatusCode":0}` {
+				t.Errorf("body = %q, want the body sent", body)
+			}
+		})
+	}
+}
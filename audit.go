@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	auditEventRequest      = "request"
+	auditEventSessionStart = "session-start"
+	auditEventSessionEnd   = "session-end"
+)
+
+// auditLog appends a JSON record of each Docker API request passing through the tunnel to a file
+// (-audit-log). Hijacked connections (attach and exec) get a record when they start, and another
+// when they end. Registry credentials and the values of environment variables and build args are not logged.
+type auditLog struct {
+	sshUser string
+	sshHost string
+	// localUser is the invoking user, recorded for clients whose user is not known.
+	localUser string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time      time.Time  `json:"time"`
+	Event     string     `json:"event"`
+	LocalUser string     `json:"localUser"`
+	SSHUser   string     `json:"sshUser"`
+	SSHHost   string     `json:"sshHost"`
+	Method    string     `json:"method"`
+	Path      string     `json:"path"`
+	Query     url.Values `json:"query,omitempty"`
+	// RegistryAuth is set if registry credentials (X-Registry-Auth) were sent.
+	RegistryAuth bool       `json:"registryAuth,omitempty"`
+	Body         *auditBody `json:"body,omitempty"`
+	Status       int        `json:"status,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	DurationMS   float64    `json:"durationMs"`
+	BytesIn      int64      `json:"bytesIn"`
+	BytesOut     int64      `json:"bytesOut"`
+}
+
+// auditBody is the redacted summary of a container or exec create request body.
+type auditBody struct {
+	Image      string       `json:"image,omitempty"`
+	Entrypoint auditStrings `json:"entrypoint,omitempty"`
+	Cmd        auditStrings `json:"cmd,omitempty"`
+	User       string       `json:"user,omitempty"`
+	Privileged bool         `json:"privileged,omitempty"`
+	Mounts     []string     `json:"mounts,omitempty"`
+	// EnvNames are the names of the environment variables, without their values.
+	EnvNames []string `json:"envNames,omitempty"`
+}
+
+// auditStrings is a list of strings that may be given as a single string in the Docker API (like Cmd).
+type auditStrings []string
+
+func (s *auditStrings) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var single string
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	*s = []string{single}
+	return nil
+}
+
+// openAuditLog opens the audit log file for appending, creating it if necessary.
+func openAuditLog(path string, target sshHost) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %v", err)
+	}
+	localUser := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	return &auditLog{
+		sshUser:   target.User,
+		sshHost:   target.Addr(),
+		localUser: localUser,
+		file:      file,
+	}, nil
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// Request records the local user and the summary of the request body, before other hooks rewrite the request.
+func (a *auditLog) Request(ctx context.Context, req *apiRequest) error {
+	record := &auditRecord{
+		Event:        auditEventRequest,
+		LocalUser:    a.clientUser(req),
+		SSHUser:      a.sshUser,
+		SSHHost:      a.sshHost,
+		Method:       req.Method,
+		Path:         req.URL.Path,
+		Query:        auditQuery(req.URL.Query()),
+		RegistryAuth: req.Header.Get("X-Registry-Auth") != "",
+	}
+	if req.Method == http.MethodPost && req.JSON != nil && (req.Path == "/containers/create" || matchPath("/containers/*/exec", req.Path)) {
+		record.Body = auditSummary(req.JSON)
+	}
+	req.Values["audit"] = record
+	return nil
+}
+
+// Response does nothing.
+func (a *auditLog) Response(ctx context.Context, req *apiRequest, resp *apiResponse) error {
+	return nil
+}
+
+// Hijacked writes the session start record of a hijacked connection.
+func (a *auditLog) Hijacked(x *apiExchange) {
+	a.write(x, auditEventSessionStart)
+}
+
+// Done writes the record of a request, or the session end record of a hijacked connection.
+func (a *auditLog) Done(x *apiExchange) {
+	if x.Hijacked {
+		a.write(x, auditEventSessionEnd)
+		return
+	}
+	a.write(x, auditEventRequest)
+}
+
+func (a *auditLog) write(x *apiExchange, event string) {
+	template, ok := x.Request.Values["audit"].(*auditRecord)
+	if !ok {
+		return
+	}
+	record := *template
+	now := time.Now()
+	record.Time = now.UTC()
+	record.Event = event
+	record.Status = x.StatusCode
+	if x.Err != nil {
+		record.Error = x.Err.Error()
+	}
+	record.DurationMS = float64(now.Sub(x.Start)) / float64(time.Millisecond)
+	record.BytesIn = atomic.LoadInt64(&x.BytesIn)
+	record.BytesOut = atomic.LoadInt64(&x.BytesOut)
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("warning: audit log: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("warning: audit log: %v", err)
+	}
+}
+
+// clientUser returns the name of the local user of the client: the owner of the connected process
+// for Unix socket connections (where supported), or else the invoking user.
+func (a *auditLog) clientUser(req *apiRequest) string {
+	uid, _, ok, err := peerCredentials(req.Client)
+	if err != nil || !ok {
+		return a.localUser
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
+
+// auditQuery returns the query parameters to log. Build args are logged by name only.
+func auditQuery(query url.Values) url.Values {
+	if buildArgs := query.Get("buildargs"); buildArgs != "" {
+		var args map[string]*string
+		var names []string
+		if json.Unmarshal([]byte(buildArgs), &args) == nil {
+			for name := range args {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		query["buildargs"] = names
+	}
+	return query
+}
+
+// auditSummary returns the redacted summary of a container or exec create request body.
+func auditSummary(body []byte) *auditBody {
+	var config struct {
+		Image      string
+		Entrypoint auditStrings
+		Cmd        auditStrings
+		User       string
+		Privileged bool
+		Env        []string
+		HostConfig struct {
+			Privileged bool
+			Binds      []string
+			Mounts     []struct {
+				Type   string
+				Source string
+				Target string
+			}
+		}
+	}
+	if json.Unmarshal(body, &config) != nil {
+		return nil
+	}
+	summary := &auditBody{
+		Image:      config.Image,
+		Entrypoint: config.Entrypoint,
+		Cmd:        config.Cmd,
+		User:       config.User,
+		Privileged: config.Privileged || config.HostConfig.Privileged,
+		Mounts:     config.HostConfig.Binds,
+	}
+	for _, mount := range config.HostConfig.Mounts {
+		summary.Mounts = append(summary.Mounts, fmt.Sprintf("type=%s,source=%s,target=%s", mount.Type, mount.Source, mount.Target))
+	}
+	for _, env := range config.Env {
+		summary.EnvNames = append(summary.EnvNames, strings.SplitN(env, "=", 2)[0])
+	}
+	return summary
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want *auditBody
+	}{
+		{name: "empty", body: `{}`, want: &auditBody{}},
+		{name: "invalid", body: `{"Image":`, want: nil},
+		{name: "invalid type", body: `{"Env":"A=1"}`, want: nil},
+		{
+			name: "container",
+			body: `{"Image":"alpine","Entrypoint":["sh","-c"],"Cmd":["echo $SECRET"],"User":"1000","Env":["SECRET=hunter2","EMPTY=","NAME"],"HostConfig":{"Binds":["/srv:/srv:ro"],"Mounts":[{"Type":"bind","Source":"/etc","Target":"/x","ReadOnly":true}]}}`,
+			want: &auditBody{
+				Image:      "alpine",
+				Entrypoint: auditStrings{"sh", "-c"},
+				Cmd:        auditStrings{"echo $SECRET"},
+				User:       "1000",
+				Mounts:     []string{"/srv:/srv:ro", "type=bind,source=/etc,target=/x"},
+				EnvNames:   []string{"SECRET", "EMPTY", "NAME"},
+			},
+		},
+		{name: "string command", body: `{"Image":"alpine","Entrypoint":"/bin/sh","Cmd":"ls"}`, want: &auditBody{Image: "alpine", Entrypoint: auditStrings{"/bin/sh"}, Cmd: auditStrings{"ls"}}},
+		{name: "privileged container", body: `{"HostConfig":{"Privileged":true}}`, want: &auditBody{Privileged: true}},
+		{name: "privileged exec", body: `{"Cmd":["sh"],"Privileged":true,"Env":["TOKEN=x"]}`, want: &auditBody{Cmd: auditStrings{"sh"}, Privileged: true, EnvNames: []string{"TOKEN"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auditSummary([]byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("auditSummary() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  url.Values
+	}{
+		{name: "empty", query: "", want: url.Values{}},
+		{name: "no build args", query: "t=app&q=1", want: url.Values{"t": {"app"}, "q": {"1"}}},
+		{name: "build args", query: "t=app&buildargs=" + url.QueryEscape(`{"TOKEN":"secret","HTTP_PROXY":null}`), want: url.Values{"t": {"app"}, "buildargs": {"HTTP_PROXY", "TOKEN"}}},
+		{name: "invalid build args", query: "buildargs=secret", want: url.Values{"buildargs": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := auditQuery(query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("auditQuery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	a, err := openAuditLog(path, sshHost{User: "alice", HostName: "example.com", Port: "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []*apiRequest{
+		testAPIRequest(t, "POST", "/v1.41/containers/create", `{"Image":"alpine","Env":["PASSWORD=env-secret"]}`),
+		testAPIRequest(t, "POST", "/v1.41/build?buildargs="+url.QueryEscape(`{"TOKEN":"arg-secret"}`), ""),
+		testAPIRequest(t, "POST", "/v1.41/images/create?fromImage=alpine", ""),
+	}
+	requests[2].Header.Set("X-Registry-Auth", "auth-secret")
+	for _, req := range requests {
+		if err := a.Request(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		a.Done(&apiExchange{Request: req, Start: time.Now(), StatusCode: 200})
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"env-secret", "arg-secret", "auth-secret"} {
+		if strings.Contains(string(buf), secret) {
+			t.Errorf("audit log contains %q:\n%s", secret, buf)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != len(requests) {
+		t.Fatalf("audit log has %d lines, want %d", len(lines), len(requests))
+	}
+	var records []auditRecord
+	for _, line := range lines {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if got := records[0].Body; got == nil || !reflect.DeepEqual(got.EnvNames, []string{"PASSWORD"}) {
+		t.Errorf("body = %+v, want the env name PASSWORD", got)
+	}
+	if got := records[1].Query["buildargs"]; !reflect.DeepEqual(got, []string{"TOKEN"}) {
+		t.Errorf("buildargs = %v, want [TOKEN]", got)
+	}
+	if !records[2].RegistryAuth {
+		t.Error("registryAuth = false, want true")
+	}
+	if records[2].SSHUser != "alice" || records[2].Status != 200 {
+		t.Errorf("record = %+v, want sshUser alice and status 200", records[2])
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// authzPluginTimeout is how long a call to an authorization plugin may take.
+	authzPluginTimeout = 30 * time.Second
+	// authzPluginMimeType is the media type of the plugin protocol, as sent by the Docker daemon.
+	authzPluginMimeType = "application/vnd.docker.plugins.v1.2+json"
+	// authzAuthNMethod is sent as the UserAuthNMethod of the requests to authorization plugins.
+	authzAuthNMethod = "SSH"
+)
+
+// authzRequest is the payload of the AuthZPlugin.AuthZReq and AuthZPlugin.AuthZRes calls,
+// in the format of the Docker daemon.
+type authzRequest struct {
+	User               string            `json:"User,omitempty"`
+	UserAuthNMethod    string            `json:"UserAuthNMethod,omitempty"`
+	RequestMethod      string            `json:"RequestMethod,omitempty"`
+	RequestURI         string            `json:"RequestUri,omitempty"`
+	RequestBody        []byte            `json:"RequestBody,omitempty"`
+	RequestHeaders     map[string]string `json:"RequestHeaders,omitempty"`
+	ResponseBody       []byte            `json:"ResponseBody,omitempty"`
+	ResponseHeaders    map[string]string `json:"ResponseHeaders,omitempty"`
+	ResponseStatusCode int               `json:"ResponseStatusCode,omitempty"`
+}
+
+// authzResponse is the reply of an authorization plugin.
+type authzResponse struct {
+	Allow bool   `json:"Allow"`
+	Msg   string `json:"Msg,omitempty"`
+	Err   string `json:"Err,omitempty"`
+}
+
+// authzPlugin is a Docker authorization plugin, reached via a Unix socket or HTTP.
+type authzPlugin struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+// newAuthzPlugin returns the plugin at the given address: a Unix socket path (or unix:// URL),
+// or an http(s):// (or tcp://) URL.
+func newAuthzPlugin(addr string) (*authzPlugin, error) {
+	if strings.HasPrefix(addr, "/") {
+		addr = "unix://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("authz plugin %q: %v", addr, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		name := strings.TrimSuffix(filepath.Base(socketPath), filepath.Ext(socketPath))
+		return &authzPlugin{
+			name: name,
+			url:  "http://" + name,
+			client: &http.Client{
+				Timeout: authzPluginTimeout,
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						var dialer net.Dialer
+						return dialer.DialContext(ctx, "unix", socketPath)
+					},
+				},
+			},
+		}, nil
+	case "tcp", "http", "https":
+		if u.Scheme == "tcp" {
+			u.Scheme = "http"
+		}
+		return &authzPlugin{
+			name:   u.Host,
+			url:    strings.TrimSuffix(u.String(), "/"),
+			client: &http.Client{Timeout: authzPluginTimeout},
+		}, nil
+	}
+	return nil, fmt.Errorf("authz plugin %q: unsupported address (use a unix socket path or an http:// URL)", addr)
+}
+
+// call sends the request to the plugin's endpoint AuthZPlugin.<method>.
+func (p *authzPlugin) call(ctx context.Context, method string, authzReq *authzRequest) (*authzResponse, error) {
+	body, err := json.Marshal(authzReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url+"/AuthZPlugin."+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", authzPluginMimeType)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var authzResp authzResponse
+	if resp.StatusCode != http.StatusOK {
+		if json.Unmarshal(buf, &authzResp) != nil || authzResp.Err == "" {
+			authzResp.Err = strings.TrimSpace(string(buf))
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, authzResp.Err)
+	}
+	if err := json.Unmarshal(buf, &authzResp); err != nil {
+		return nil, err
+	}
+	if authzResp.Err != "" {
+		return nil, fmt.Errorf("%s", authzResp.Err)
+	}
+	return &authzResp, nil
+}
+
+// authz delegates the authorization of the Docker API requests passing through the tunnel to
+// Docker authorization plugins (-authz-plugin), like the Docker daemon does: each request is
+// sent to the plugins before it is forwarded, and again along with its response.
+// All plugins must allow a request.
+type authz struct {
+	plugins []*authzPlugin
+	user    string
+}
+
+// newAuthz returns an authz hook for the plugins at the given addresses, for the given (ssh) user.
+func newAuthz(addrs []string, user string) (*authz, error) {
+	a := &authz{user: user}
+	for _, addr := range addrs {
+		plugin, err := newAuthzPlugin(addr)
+		if err != nil {
+			return nil, err
+		}
+		a.plugins = append(a.plugins, plugin)
+	}
+	return a, nil
+}
+
+// Request asks the plugins to authorize the request.
+func (a *authz) Request(ctx context.Context, req *apiRequest) error {
+	authzReq := &authzRequest{
+		User:            a.user,
+		UserAuthNMethod: authzAuthNMethod,
+		RequestMethod:   req.Method,
+		RequestURI:      req.RequestURI,
+		RequestHeaders:  authzHeaders(req.Header),
+	}
+	if authzSendBody(req.URL.Path, req.Header) {
+		authzReq.RequestBody = req.JSON
+	}
+	req.Values["authz"] = authzReq
+	return a.call(ctx, req, "AuthZReq", authzReq)
+}
+
+// Response asks the plugins to authorize the response. Streamed and hijacked responses are
+// sent without their body.
+func (a *authz) Response(ctx context.Context, req *apiRequest, resp *apiResponse) error {
+	authzReq, ok := req.Values["authz"].(*authzRequest)
+	if !ok {
+		return nil
+	}
+	authzRes := *authzReq
+	authzRes.ResponseStatusCode = resp.StatusCode
+	authzRes.ResponseHeaders = authzHeaders(resp.Header)
+	if authzSendBody(req.URL.Path, resp.Header) {
+		authzRes.ResponseBody = resp.JSON
+	}
+	return a.call(ctx, req, "AuthZRes", &authzRes)
+}
+
+func (a *authz) call(ctx context.Context, req *apiRequest, method string, authzReq *authzRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, authzPluginTimeout)
+	defer cancel()
+	for _, plugin := range a.plugins {
+		authzResp, err := plugin.call(ctx, method, authzReq)
+		if err != nil {
+			log.Printf("warning: authz plugin %s: %s %s: %v", plugin.name, req.Method, req.URL.RequestURI(), err)
+			return &apiError{
+				StatusCode: http.StatusInternalServerError,
+				Message:    fmt.Sprintf("plugin %s failed with error: %s: %v", plugin.name, "AuthZPlugin."+method, err),
+			}
+		}
+		if !authzResp.Allow {
+			log.Printf("denied %s %s by authz plugin %s: %s", req.Method, req.URL.RequestURI(), plugin.name, authzResp.Msg)
+			return &apiError{
+				StatusCode: http.StatusForbidden,
+				Message:    fmt.Sprintf("authorization denied by plugin %s: %s", plugin.name, authzResp.Msg),
+			}
+		}
+	}
+	return nil
+}
+
+// authzSkipHeaders are the headers that are not sent to the plugins, as they contain credentials.
+// The daemon skips the same headers.
+var authzSkipHeaders = []string{"Authorization", "X-Registry-Auth", "X-Registry-Config"}
+
+// authzHeaders returns the headers sent to the plugins: the last value of each header,
+// except for those with credentials (authzSkipHeaders).
+func authzHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for key, values := range header {
+		if containsFold(authzSkipHeaders, key) {
+			continue
+		}
+		for _, value := range values {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// authzSendBody returns whether a body with the given headers is sent to the plugins:
+// JSON bodies are, except for those of the /auth endpoint (which contain credentials).
+func authzSendBody(urlPath string, header http.Header) bool {
+	if strings.HasSuffix(urlPath, "/auth") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAuthzHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   map[string]string
+	}{
+		{name: "empty", header: http.Header{}, want: map[string]string{}},
+		{
+			name:   "last value",
+			header: http.Header{"Content-Type": {"application/json"}, "X-Custom": {"a", "b"}},
+			want:   map[string]string{"Content-Type": "application/json", "X-Custom": "b"},
+		},
+		{
+			name: "credentials",
+			header: http.Header{
+				"Authorization":     {"Basic dXNlcjpzZWNyZXQ="},
+				"X-Registry-Auth":   {"secret"},
+				"X-Registry-Config": {"secret"},
+				"User-Agent":        {"Docker-Client"},
+			},
+			want: map[string]string{"User-Agent": "Docker-Client"},
+		},
+		{
+			name: "credentials, not canonical",
+			header: http.Header{
+				"authorization":     {"secret"},
+				"x-registry-auth":   {"secret"},
+				"X-REGISTRY-CONFIG": {"secret"},
+			},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := authzHeaders(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("authzHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthzRequest(t *testing.T) {
+	var got authzRequest
+	plugin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/AuthZPlugin.AuthZReq" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(authzResponse{Allow: true})
+	}))
+	defer plugin.Close()
+	a, err := newAuthz([]string{plugin.URL}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := testAPIRequest(t, "POST", "/v1.41/build?t=app", "")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Registry-Auth", "secret")
+	req.Header.Set("X-Registry-Config", "secret")
+	req.Header.Set("User-Agent", "Docker-Client")
+	if err := a.Request(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if got.User != "alice" || got.UserAuthNMethod != authzAuthNMethod || got.RequestMethod != "POST" || got.RequestURI != "/v1.41/build?t=app" {
+		t.Errorf("AuthZReq = %+v, want user alice and the request's method and URI", got)
+	}
+	if want := map[string]string{"User-Agent": "Docker-Client"}; !reflect.DeepEqual(got.RequestHeaders, want) {
+		t.Errorf("RequestHeaders = %v, want %v", got.RequestHeaders, want)
+	}
+}
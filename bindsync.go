@@ -0,0 +1,607 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// bindSyncCleanupTimeout is how long removing the remote staging directory may take when exiting.
+const bindSyncCleanupTimeout = 10 * time.Second
+
+// windowsDrivePath matches the start of an absolute Windows path (C:\ or C:/).
+var windowsDrivePath = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+
+// bindSync copies the local sources of the bind mounts of created containers to a staging
+// directory on the remote host, and points the bind mounts there instead (-sync-binds).
+// Optionally, the staged directories are copied back whenever the containers exit.
+type bindSync struct {
+	session *session
+	docker  *http.Client
+	dir     string
+	back    bool
+	// roots are the (resolved) local directories whose contents may be copied.
+	roots []string
+	// maxSize is the maximum total size of the files of a copied source.
+	maxSize int64
+
+	mu     sync.Mutex
+	remote string
+	count  int
+}
+
+// stagedBind is a local bind mount source that has been copied to the remote host.
+type stagedBind struct {
+	// Local is the local source path.
+	Local string
+	// Dir is the remote staging directory. If the source is a file, it is the only entry of Dir.
+	Dir string
+	// Source is the rewritten (remote) source path.
+	Source string
+	// IsDir is set if the source is a directory.
+	IsDir bool
+}
+
+// newBindSync returns a bindSync that copies files over the session, and talks to the remote daemon
+// using dialDocker. The staging directory is created in the remote directory dir (default: $TMPDIR or /tmp).
+// Only sources inside of the given local directories (default: the working directory and the home
+// directory) with at most maxSize bytes of files are copied.
+func newBindSync(s *session, dialDocker func(context.Context) (net.Conn, error), dir string, back bool, roots []string, maxSize int64) *bindSync {
+	return &bindSync{
+		session: s,
+		docker:  dockerAPIClient(dialDocker),
+		dir:     dir,
+		back:    back,
+		roots:   bindSyncRoots(roots),
+		maxSize: maxSize,
+	}
+}
+
+// bindSyncRoots resolves the given directories, or else the working directory and the home directory.
+// The root directory of the file system is left out.
+func bindSyncRoots(dirs []string) []string {
+	if len(dirs) == 0 {
+		if wd, err := os.Getwd(); err == nil {
+			dirs = append(dirs, wd)
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			dirs = append(dirs, home)
+		}
+	}
+	var roots []string
+	for _, dir := range dirs {
+		root, err := filepath.Abs(dir)
+		if err == nil {
+			root, err = filepath.EvalSymlinks(root)
+		}
+		if err != nil {
+			log.Printf("warning: -sync-binds-root %s: %v", dir, err)
+			continue
+		}
+		if isFileSystemRoot(root) {
+			log.Printf("warning: not syncing bind mounts from %s (the root directory)", dir)
+			continue
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// isFileSystemRoot returns whether the (clean, absolute) path is / or a Windows volume root.
+func isFileSystemRoot(p string) bool {
+	return filepath.Dir(p) == p
+}
+
+// Request stages the local bind mount sources of POST /containers/create requests.
+func (b *bindSync) Request(ctx context.Context, req *apiRequest) error {
+	if req.Method != http.MethodPost || req.Path != "/containers/create" || req.JSON == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(req.JSON))
+	decoder.UseNumber()
+	var body map[string]interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil
+	}
+	hostConfig, ok := body["HostConfig"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	staged := make(map[string]*stagedBind)
+	stage := func(source string) (string, error) {
+		if !b.isLocalSource(source) {
+			return source, nil
+		}
+		if s, ok := staged[source]; ok {
+			return s.Source, nil
+		}
+		s, err := b.stage(ctx, source)
+		if err != nil {
+			return "", &apiError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("sync bind mount %s: %v", source, err)}
+		}
+		staged[source] = s
+		return s.Source, nil
+	}
+	if binds, ok := hostConfig["Binds"].([]interface{}); ok {
+		for i, bind := range binds {
+			bind, ok := bind.(string)
+			if !ok {
+				continue
+			}
+			source, rest := splitBind(bind)
+			source, err := stage(source)
+			if err != nil {
+				return err
+			}
+			binds[i] = source + rest
+		}
+	}
+	if mounts, ok := hostConfig["Mounts"].([]interface{}); ok {
+		for _, mount := range mounts {
+			mount, ok := mount.(map[string]interface{})
+			if !ok || mount["Type"] != "bind" {
+				continue
+			}
+			source, ok := mount["Source"].(string)
+			if !ok {
+				continue
+			}
+			source, err := stage(source)
+			if err != nil {
+				return err
+			}
+			mount["Source"] = source
+		}
+	}
+	if len(staged) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req.JSON = buf
+	req.Values["bindSync"] = staged
+	return nil
+}
+
+// Response starts copying the staged directories back whenever the created container exits (if enabled).
+func (b *bindSync) Response(ctx context.Context, req *apiRequest, resp *apiResponse) error {
+	staged, ok := req.Values["bindSync"].(map[string]*stagedBind)
+	if !ok || !b.back || resp.StatusCode != http.StatusCreated || resp.JSON == nil {
+		return nil
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := json.Unmarshal(resp.JSON, &created); err != nil || created.ID == "" {
+		return nil
+	}
+	go b.syncBack(created.ID, staged)
+	return nil
+}
+
+// isLocalSource returns whether the given bind mount source is an existing local directory or file
+// to copy: one inside of the roots. Other existing sources are logged, and mounted from the remote host.
+func (b *bindSync) isLocalSource(source string) bool {
+	if !filepath.IsAbs(source) {
+		return false
+	}
+	info, err := os.Stat(source)
+	if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return false
+	}
+	if !isFileSystemRoot(resolved) {
+		for _, root := range b.roots {
+			if insideDir(root, resolved) {
+				return true
+			}
+		}
+	}
+	log.Printf("warning: not syncing bind mount source %s, which is outside of the -sync-binds-root directories (%s); it refers to the remote host", source, strings.Join(b.roots, ", "))
+	return false
+}
+
+// splitBind splits a HostConfig.Binds entry (source:target[:options]) into the source and the rest.
+func splitBind(bind string) (source, rest string) {
+	start := 0
+	if runtime.GOOS == "windows" && windowsDrivePath.MatchString(bind) {
+		start = 2
+	}
+	i := strings.IndexByte(bind[start:], ':')
+	if i < 0 {
+		return bind, ""
+	}
+	return bind[:start+i], bind[start+i:]
+}
+
+// stage copies the given local directory or file to a new staging directory on the remote host.
+func (b *bindSync) stage(ctx context.Context, local string) (*stagedBind, error) {
+	remote, err := b.remoteDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.count++
+	dir := path.Join(remote, fmt.Sprintf("%d-%s", b.count, sanitizeFileName(filepath.Base(local))))
+	b.mu.Unlock()
+	root, err := filepath.EvalSymlinks(local)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	s := &stagedBind{Local: local, Dir: dir, Source: dir, IsDir: info.IsDir()}
+	if !s.IsDir {
+		s.Source = path.Join(dir, sanitizeFileName(filepath.Base(local)))
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, root, path.Base(s.Source), b.maxSize))
+	}()
+	command := fmt.Sprintf("mkdir -p %s && tar -xf - -C %s", quoteSh(dir), quoteSh(dir))
+	if err := runRemoteCommand(ctx, b.session, command, reader, nil); err != nil {
+		reader.CloseWithError(err)
+		return nil, err
+	}
+	if flags.Verbose {
+		log.Printf("synced %s to %s on the remote host", local, s.Source)
+	}
+	return s, nil
+}
+
+// remoteDir returns the remote staging directory of this session, creating it on first use.
+// It is removed when exiting.
+func (b *bindSync) remoteDir(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remote != "" {
+		return b.remote, nil
+	}
+	parent := `"${TMPDIR:-/tmp}"`
+	if b.dir != "" {
+		parent = quoteSh(b.dir)
+	}
+	var stdout bytes.Buffer
+	command := fmt.Sprintf("mkdir -p %s && mktemp -d %s/%s.XXXXXX", parent, parent, appName)
+	if err := runRemoteCommand(ctx, b.session, command, nil, &stdout); err != nil {
+		return "", fmt.Errorf("create remote staging directory: %v", err)
+	}
+	b.remote = strings.TrimSpace(stdout.String())
+	if b.remote == "" {
+		return "", fmt.Errorf("create remote staging directory: no directory name returned")
+	}
+	remote := b.remote
+	state.cleanup = append(state.cleanup, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), bindSyncCleanupTimeout)
+		defer cancel()
+		if err := runRemoteCommand(ctx, b.session, "rm -rf "+quoteSh(remote), nil, nil); err != nil {
+			log.Printf("warning: remove remote staging directory %s: %v", remote, err)
+		}
+	})
+	return b.remote, nil
+}
+
+// syncBack copies the staged directories back each time the given container exits, until it is removed.
+func (b *bindSync) syncBack(id string, staged map[string]*stagedBind) {
+	for {
+		req, err := http.NewRequest(http.MethodPost, "http://docker/containers/"+url.PathEscape(id)+"/wait?condition=next-exit", nil)
+		if err != nil {
+			return
+		}
+		resp, err := b.docker.Do(req)
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+		for _, s := range staged {
+			if err := b.copyBack(s); err != nil {
+				log.Printf("warning: sync back %s: %v", s.Local, err)
+				continue
+			}
+			if flags.Verbose {
+				log.Printf("synced %s back to %s", s.Source, s.Local)
+			}
+		}
+	}
+}
+
+// copyBack copies the content of the staged directory (or file) back to the local source,
+// failing if its files are larger than -sync-binds-max-size in total.
+func (b *bindSync) copyBack(s *stagedBind) error {
+	ctx := context.Background()
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	command := "tar -cf - -C " + quoteSh(s.Dir) + " ."
+	if !s.IsDir {
+		command = "cat " + quoteSh(s.Source)
+	}
+	go func() {
+		var err error
+		if s.IsDir {
+			err = extractTar(reader, s.Local, b.maxSize)
+			if err == nil {
+				// Read the padding following the end of the archive.
+				io.Copy(ioutil.Discard, reader)
+			}
+		} else {
+			err = replaceFile(s.Local, reader, b.maxSize)
+		}
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	err := runRemoteCommand(ctx, b.session, command, nil, writer)
+	writer.CloseWithError(err)
+	if errExtract := <-done; err == nil {
+		err = errExtract
+	}
+	return err
+}
+
+// runRemoteCommand runs the given command on the remote host, with the given stdin and stdout (both optional).
+func runRemoteCommand(ctx context.Context, s *session, command string, stdin io.Reader, stdout io.Writer) error {
+	client, err := s.Client(ctx)
+	if err != nil {
+		return err
+	}
+	sshSession, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sshSession.Close()
+	var stderr bytes.Buffer
+	sshSession.Stdin = stdin
+	sshSession.Stdout = stdout
+	sshSession.Stderr = &stderr
+	done := make(chan error, 1)
+	go func() {
+		done <- sshSession.Run(command)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok && stderr.Len() > 0 {
+		return fmt.Errorf("%v: %s", exitErr, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// writeTar writes a tar archive of the given directory (or file, using the given name) to w.
+// Only directories, regular files and symbolic links are included. It fails if the files are larger
+// than maxSize bytes in total.
+func writeTar(w io.Writer, root, fileName string, maxSize int64) error {
+	tw := tar.NewWriter(w)
+	var size int64
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.IsDir(), info.Mode().IsRegular():
+		default:
+			return nil
+		}
+		name := fileName
+		if p != root || info.IsDir() {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			name = filepath.ToSlash(rel)
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Uname, header.Gname = "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if size += info.Size(); size > maxSize {
+			return fmt.Errorf("%s is larger than %d bytes (-sync-binds-max-size)", root, maxSize)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extractTar extracts the directories, regular files and symbolic links of the tar archive into dir.
+// Entries outside of dir, and symbolic links to absolute paths or containing "..", are skipped.
+// Existing files and symbolic links are replaced rather than written through. It fails before
+// extracting a file that makes the extracted files larger than maxSize bytes in total.
+func extractTar(r io.Reader, dir string, maxSize int64) error {
+	tr := tar.NewReader(r)
+	var size int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if !insideDir(dir, filepath.Dir(target)) {
+			continue
+		}
+		existing, err := os.Lstat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if existing != nil && existing.IsDir() {
+				continue
+			}
+			if existing != nil {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			if err := os.Mkdir(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if size += header.Size; size > maxSize {
+				return fmt.Errorf("%s is larger than %d bytes (-sync-binds-max-size)", dir, maxSize)
+			}
+			if existing != nil {
+				if existing.IsDir() {
+					return fmt.Errorf("%s: is a directory", target)
+				}
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			// With O_EXCL, the file is created anew rather than written through a symbolic link.
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !isRelativeLink(header.Linkname) {
+				log.Printf("warning: not extracting the symbolic link %s to %s", name, header.Linkname)
+				continue
+			}
+			if existing != nil {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replaceFile replaces the file p with the content read from r, failing if it is larger than
+// maxSize bytes. The content is written to a new file that is then renamed to p, so that the file
+// is replaced rather than written through a symbolic link, and is left as is if the copy fails.
+func replaceFile(p string, r io.Reader, maxSize int64) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Lstat(p); err == nil && info.Mode().IsRegular() {
+		mode = info.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, maxSize+1))
+	if err == nil && n > maxSize {
+		err = fmt.Errorf("%s is larger than %d bytes (-sync-binds-max-size)", p, maxSize)
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// isRelativeLink returns whether the symbolic link target is a relative path without "..".
+func isRelativeLink(link string) bool {
+	if link == "" || path.IsAbs(link) || filepath.IsAbs(link) || filepath.VolumeName(link) != "" {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(link, func(c rune) bool { return c == '/' || c == filepath.Separator }) {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// insideDir returns whether the directory p is (after resolving symbolic links) dir or inside of it.
+// Directories that do not exist yet are created by extractTar, and so are inside.
+func insideDir(dir, p string) bool {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		return insideDir(dir, filepath.Dir(p))
+	}
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(resolvedDir, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// sanitizeFileName replaces characters other than letters, digits, '.', '_' and '-' in the given name.
+func sanitizeFileName(name string) string {
+	return regexp.MustCompile(`[^A-Za-z0-9._-]`).ReplaceAllString(name, "_")
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test tar archive.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func testTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// readTree returns the files (as their content) and symbolic links (as "-> target") below dir.
+func readTree(t *testing.T, dir string) map[string]string {
+	tree := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "-> " + filepath.ToSlash(link)
+		case info.IsDir():
+			tree[rel+"/"] = ""
+		default:
+			buf, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = string(buf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestExtractTar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links are not generally available on Windows")
+	}
+	tests := []struct {
+		name string
+		// setup prepares the extraction directory dir, and the directory outside of it.
+		setup   func(t *testing.T, dir, outside string)
+		entries []tarEntry
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "files and directories",
+			entries: []tarEntry{
+				{name: "a/", typeflag: tar.TypeDir},
+				{name: "a/b", typeflag: tar.TypeReg, body: "b"},
+				{name: "c", typeflag: tar.TypeReg, body: "c"},
+			},
+			want: map[string]string{"a/": "", "a/b": "b", "c": "c"},
+		},
+		{
+			name: "existing file is replaced",
+			setup: func(t *testing.T, dir, outside string) {
+				writeTestFile(t, filepath.Join(dir, "a"), "old")
+			},
+			entries: []tarEntry{{name: "a", typeflag: tar.TypeReg, body: "new"}},
+			want:    map[string]string{"a": "new"},
+		},
+		{
+			name:    "parent directory references stay inside",
+			entries: []tarEntry{{name: "../../escaped", typeflag: tar.TypeReg, body: "x"}},
+			want:    map[string]string{"escaped": "x"},
+		},
+		{
+			name: "relative symbolic link",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeReg, body: "a"},
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "a"},
+				{name: "c/", typeflag: tar.TypeDir},
+				{name: "c/d", typeflag: tar.TypeSymlink, linkname: "./e/f"},
+			},
+			want: map[string]string{"a": "a", "b": "-> a", "c/": "", "c/d": "-> ./e/f"},
+		},
+		{
+			name: "absolute symbolic link is skipped",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+			},
+			want: map[string]string{},
+		},
+		{
+			name: "symbolic link with .. is skipped",
+			entries: []tarEntry{
+				{name: "a/", typeflag: tar.TypeDir},
+				{name: "a/up", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "x/../y"},
+			},
+			want: map[string]string{"a/": ""},
+		},
+		{
+			name: "file replaces a symbolic link instead of writing through it",
+			setup: func(t *testing.T, dir, outside string) {
+				writeTestFile(t, filepath.Join(outside, "target"), "outside")
+				symlinkTestFile(t, filepath.Join(outside, "target"), filepath.Join(dir, "link"))
+			},
+			entries: []tarEntry{{name: "link", typeflag: tar.TypeReg, body: "inside"}},
+			want:    map[string]string{"link": "inside"},
+		},
+		{
+			name: "symbolic link written by the archive is not followed",
+			entries: []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "a"},
+				{name: "link", typeflag: tar.TypeReg, body: "inside"},
+			},
+			want: map[string]string{"link": "inside"},
+		},
+		{
+			name: "directory replaces a symbolic link",
+			setup: func(t *testing.T, dir, outside string) {
+				symlinkTestFile(t, outside, filepath.Join(dir, "link"))
+			},
+			entries: []tarEntry{{name: "link/", typeflag: tar.TypeDir}},
+			want:    map[string]string{"link/": ""},
+		},
+		{
+			name: "entries below a symbolic link to the outside are skipped",
+			setup: func(t *testing.T, dir, outside string) {
+				symlinkTestFile(t, outside, filepath.Join(dir, "link"))
+			},
+			entries: []tarEntry{{name: "link/file", typeflag: tar.TypeReg, body: "x"}},
+			want:    map[string]string{"link": "-> " + "OUTSIDE"},
+		},
+		{
+			name: "file does not replace a directory",
+			setup: func(t *testing.T, dir, outside string) {
+				writeTestFile(t, filepath.Join(dir, "a", "b"), "b")
+			},
+			entries: []tarEntry{{name: "a", typeflag: tar.TypeReg, body: "a"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "extract-tar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			dir, outside := filepath.Join(tmp, "dir"), filepath.Join(tmp, "outside")
+			for _, d := range []string{dir, outside} {
+				if err := os.Mkdir(d, 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.setup != nil {
+				tt.setup(t, dir, outside)
+			}
+			outsideBefore := readTree(t, outside)
+
+			err = extractTar(testTar(t, tt.entries), dir, 1<<20)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractTar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if outsideAfter := readTree(t, outside); !equalTrees(outsideBefore, outsideAfter) {
+				t.Errorf("extractTar() changed the outside directory: %v, was %v", outsideAfter, outsideBefore)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := make(map[string]string)
+			for name, content := range tt.want {
+				if content == "-> OUTSIDE" {
+					content = "-> " + filepath.ToSlash(outside)
+				}
+				want[name] = content
+			}
+			if got := readTree(t, dir); !equalTrees(got, want) {
+				t.Errorf("extractTar() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlinkTestFile(t *testing.T, target, path string) {
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equalTrees(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, content := range a {
+		if other, ok := b[name]; !ok || other != content {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIsRelativeLink(t *testing.T) {
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{link: "a", want: true},
+		{link: "a/b", want: true},
+		{link: "./a", want: true},
+		{link: "a..b", want: true},
+		{link: "", want: false},
+		{link: "/etc/passwd", want: false},
+		{link: "..", want: false},
+		{link: "../a", want: false},
+		{link: "a/../../b", want: false},
+		{link: "a/..", want: false},
+	}
+	for _, tt := range tests {
+		if got := isRelativeLink(tt.link); got != tt.want {
+			t.Errorf("isRelativeLink(%q) = %v, want %v", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestSplitBind(t *testing.T) {
+	tests := []struct {
+		bind       string
+		wantSource string
+		wantRest   string
+	}{
+		{bind: "/src:/dst", wantSource: "/src", wantRest: ":/dst"},
+		{bind: "/src:/dst:ro", wantSource: "/src", wantRest: ":/dst:ro"},
+		{bind: "volume:/dst", wantSource: "volume", wantRest: ":/dst"},
+		{bind: "/src", wantSource: "/src", wantRest: ""},
+		{bind: "", wantSource: "", wantRest: ""},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests,
+			struct{ bind, wantSource, wantRest string }{bind: `C:\src:/dst`, wantSource: `C:\src`, wantRest: ":/dst"},
+			struct{ bind, wantSource, wantRest string }{bind: "C:/src:/dst:ro", wantSource: "C:/src", wantRest: ":/dst:ro"},
+		)
+	} else {
+		tests = append(tests,
+			struct{ bind, wantSource, wantRest string }{bind: `C:\src:/dst`, wantSource: "C", wantRest: `:\src:/dst`},
+		)
+	}
+	for _, tt := range tests {
+		source, rest := splitBind(tt.bind)
+		if source != tt.wantSource || rest != tt.wantRest {
+			t.Errorf("splitBind(%q) = %q, %q, want %q, %q", tt.bind, source, rest, tt.wantSource, tt.wantRest)
+		}
+	}
+}
+
+func TestBindSyncIsLocalSource(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bind-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root, other := filepath.Join(tmp, "root"), filepath.Join(tmp, "other")
+	writeTestFile(t, filepath.Join(root, "dir", "file"), "x")
+	writeTestFile(t, filepath.Join(other, "file"), "x")
+	if runtime.GOOS != "windows" {
+		symlinkTestFile(t, other, filepath.Join(root, "link"))
+	}
+	b := &bindSync{roots: bindSyncRoots([]string{root, string(filepath.Separator)})}
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{source: root, want: true},
+		{source: filepath.Join(root, "dir"), want: true},
+		{source: filepath.Join(root, "dir", "file"), want: true},
+		{source: filepath.Join(root, "missing"), want: false},
+		{source: other, want: false},
+		{source: filepath.Join(other, "file"), want: false},
+		{source: string(filepath.Separator), want: false},
+		{source: "volume", want: false},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			source string
+			want   bool
+		}{source: filepath.Join(root, "link"), want: false})
+	}
+	for _, tt := range tests {
+		if got := b.isLocalSource(tt.source); got != tt.want {
+			t.Errorf("isLocalSource(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestTarMaxSize(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "write-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	writeTestFile(t, filepath.Join(root, "a"), "12345")
+	writeTestFile(t, filepath.Join(root, "b", "c"), "67890")
+	var archive bytes.Buffer
+	if err := writeTar(&archive, root, "", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		maxSize int64
+		wantErr bool
+	}{
+		{maxSize: 10},
+		{maxSize: 9, wantErr: true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeTar(&buf, root, "", tt.maxSize); (err != nil) != tt.wantErr {
+			t.Errorf("writeTar(maxSize %d) error = %v, wantErr %v", tt.maxSize, err, tt.wantErr)
+		}
+		dir := filepath.Join(tmp, "extracted")
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		err := extractTar(bytes.NewReader(archive.Bytes()), dir, tt.maxSize)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("extractTar(maxSize %d) error = %v, wantErr %v", tt.maxSize, err, tt.wantErr)
+		}
+		if err == nil {
+			if got, want := readTree(t, dir), map[string]string{"a": "12345", "b/": "", "b/c": "67890"}; !equalTrees(got, want) {
+				t.Errorf("extracted %v, want %v", got, want)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, dir, outside string)
+		content string
+		wantErr bool
+		want    map[string]string
+	}{
+		{name: "new", content: "new", want: map[string]string{"file": "new"}},
+		{
+			name:    "existing",
+			setup:   func(t *testing.T, dir, outside string) { writeTestFile(t, filepath.Join(dir, "file"), "old") },
+			content: "new",
+			want:    map[string]string{"file": "new"},
+		},
+		{
+			name: "symlinked",
+			setup: func(t *testing.T, dir, outside string) {
+				writeTestFile(t, filepath.Join(outside, "target"), "old")
+				if err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(dir, "file")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			content: "new",
+			want:    map[string]string{"file": "new"},
+		},
+		{
+			name:    "too large",
+			setup:   func(t *testing.T, dir, outside string) { writeTestFile(t, filepath.Join(dir, "file"), "old") },
+			content: "123456",
+			wantErr: true,
+			want:    map[string]string{"file": "old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "replace-file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			dir, outside := filepath.Join(tmp, "dir"), filepath.Join(tmp, "outside")
+			for _, d := range []string{dir, outside} {
+				if err := os.Mkdir(d, 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.setup != nil {
+				tt.setup(t, dir, outside)
+			}
+			outsideBefore := readTree(t, outside)
+
+			err = replaceFile(filepath.Join(dir, "file"), strings.NewReader(tt.content), 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replaceFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if outsideAfter := readTree(t, outside); !equalTrees(outsideBefore, outsideAfter) {
+				t.Errorf("replaceFile() changed the outside directory: %v, was %v", outsideAfter, outsideBefore)
+			}
+			if got := readTree(t, dir); !equalTrees(got, tt.want) {
+				t.Errorf("replaceFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
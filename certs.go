@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certificatePath returns the path of the companion certificate of the given key file.
+func certificatePath(keyPath string) string {
+	return keyPath + "-cert.pub"
+}
+
+// readCertificateFile reads an OpenSSH user certificate.
+// It returns nil (and no error) if the file does not exist.
+func readCertificateFile(path string) (*ssh.Certificate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a certificate", path)
+	}
+	return cert, nil
+}
+
+// checkCertificate returns an error if the given certificate is not a user certificate,
+// or is not valid at the current time.
+func checkCertificate(cert *ssh.Certificate) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate %q is not a user certificate", cert.KeyId)
+	}
+	now := time.Now()
+	if after := int64(cert.ValidAfter); after < 0 || now.Unix() < after {
+		return fmt.Errorf("certificate %q is not valid before %s", cert.KeyId, certificateTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		if before := int64(cert.ValidBefore); before < 0 || now.Unix() >= before {
+			return fmt.Errorf("certificate %q expired at %s", cert.KeyId, certificateTime(cert.ValidBefore))
+		}
+	}
+	return nil
+}
+
+func certificateTime(t uint64) string {
+	if int64(t) < 0 {
+		return "forever"
+	}
+	return time.Unix(int64(t), 0).Format(time.RFC3339)
+}
+
+// asCertificate returns the given public key as a certificate, if it is one.
+// (Keys listed by an ssh-agent are not *ssh.Certificate values, even if they are certificates.)
+func asCertificate(key ssh.PublicKey) (*ssh.Certificate, bool) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return cert, true
+	}
+	parsed, err := ssh.ParsePublicKey(key.Marshal())
+	if err != nil {
+		return nil, false
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	return cert, ok
+}
+
+// findCertificate returns the first of the given certificates that certifies the given key, or nil.
+func findCertificate(certs []*ssh.Certificate, key ssh.PublicKey) *ssh.Certificate {
+	for _, cert := range certs {
+		if string(cert.Key.Marshal()) == string(key.Marshal()) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// certificateSigner returns the signer wrapped with the certificate for its key: the companion
+// certificate file of keyPath (if given), or else the first matching one of certs. If there is
+// no certificate for the key, the signer is returned unchanged.
+func certificateSigner(signer ssh.Signer, keyPath string, certs []*ssh.Certificate) (ssh.Signer, error) {
+	var cert *ssh.Certificate
+	var certPath string
+	if keyPath != "" {
+		var err error
+		certPath = certificatePath(keyPath)
+		cert, err = readCertificateFile(certPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cert == nil {
+		certPath = ""
+		cert = findCertificate(certs, signer.PublicKey())
+	}
+	if cert == nil {
+		return signer, nil
+	}
+	if err := checkCertificate(cert); err != nil {
+		if certPath != "" {
+			return nil, fmt.Errorf("%s: %v", certPath, err)
+		}
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %q: %v", cert.KeyId, err)
+	}
+	return certSigner, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// exitCodeTunnelFailure is the exit code used when the tunnel cannot be set up or fails
+// while the command is running. As with ssh(1), it is 255.
+const exitCodeTunnelFailure = 255
+
+// fatalTunnelf logs a tunnel failure, cleans up, and exits with exitCodeTunnelFailure.
+func fatalTunnelf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	runCleanup()
+	os.Exit(exitCodeTunnelFailure)
+}
+
+// tunnelFailed reports a tunnel failure to runCommand.
+func tunnelFailed(err error) {
+	select {
+	case state.tunnelErr <- err:
+	default:
+	}
+}
+
+func runCleanup() {
+	for i := len(state.cleanup) - 1; i >= 0; i-- {
+		state.cleanup[i]()
+	}
+	state.cleanup = nil
+}
+
+// runCommand runs cmd and returns its exit code, or 128+n if it was killed by signal n.
+//
+// Received signals are forwarded to the command's process group. If the command does not exit
+// within the -kill-grace-period after the first forwarded signal (or SIGTERM), it is killed.
+// When the command shares our terminal, SIGINT and SIGHUP are not forwarded, since the terminal
+// delivers them to the command directly. As the sender of a signal is not known, this includes
+// those sent by other means (e.g. using kill(1)); SIGTERM is forwarded in any case.
+// If the tunnel fails, the command is terminated the same way and exitCodeTunnelFailure is returned.
+func runCommand(cmd *exec.Cmd, signals <-chan os.Signal) int {
+	child := prepareCommand(cmd)
+	if err := cmd.Start(); err != nil {
+		log.Printf("%v", err)
+		if errors.Is(err, exec.ErrNotFound) || os.IsNotExist(err) {
+			return 127
+		}
+		return 126
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	var kill <-chan time.Time
+	terminate := func() {
+		if kill == nil {
+			kill = time.After(flags.KillGracePeriod)
+		}
+	}
+	failed := false
+	for {
+		select {
+		case s := <-signals:
+			if child.signal(s) {
+				log.Printf("received %v signal, forwarded to command", s)
+				terminate()
+			} else {
+				log.Printf("received %v signal", s)
+				if s == syscall.SIGTERM {
+					terminate()
+				}
+			}
+		case err := <-state.tunnelErr:
+			log.Printf("tunnel connection failed: %v", err)
+			failed = true
+			child.signal(syscall.SIGTERM)
+			terminate()
+		case <-kill:
+			log.Printf("command did not exit within %v, killing it", flags.KillGracePeriod)
+			child.kill()
+		case <-exited:
+			if failed {
+				return exitCodeTunnelFailure
+			}
+			if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return cmd.ProcessState.ExitCode()
+		}
+	}
+}
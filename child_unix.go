@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// childProcess is a started command, for signalling purposes.
+type childProcess struct {
+	cmd *exec.Cmd
+	// sharesTerminal is set if the command runs in our process group in the foreground of
+	// a terminal, so that signals generated by the terminal reach it directly.
+	sharesTerminal bool
+}
+
+// prepareCommand places the command in a process group of its own, unless we are running in the
+// foreground of a terminal, where doing so would break job control.
+func prepareCommand(cmd *exec.Cmd) *childProcess {
+	if isForegroundTerminal(os.Stdin) {
+		return &childProcess{cmd: cmd, sharesTerminal: true}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return &childProcess{cmd: cmd}
+}
+
+// signal forwards the signal to the command's process group and reports whether it did so.
+// When sharing a terminal, only SIGTERM is forwarded (to the command itself), since SIGINT
+// and SIGHUP have already been delivered to the command by the terminal.
+func (c *childProcess) signal(s os.Signal) bool {
+	sig, ok := s.(syscall.Signal)
+	if !ok {
+		return false
+	}
+	if c.sharesTerminal {
+		if sig != syscall.SIGTERM {
+			return false
+		}
+		return syscall.Kill(c.cmd.Process.Pid, sig) == nil
+	}
+	return syscall.Kill(-c.cmd.Process.Pid, sig) == nil
+}
+
+func (c *childProcess) kill() {
+	if c.sharesTerminal {
+		c.cmd.Process.Kill()
+		return
+	}
+	syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// isForegroundTerminal returns whether f is a terminal whose foreground process group is ours.
+func isForegroundTerminal(f *os.File) bool {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
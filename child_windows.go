@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// childProcess is a started command, for signalling purposes.
+type childProcess struct {
+	cmd *exec.Cmd
+}
+
+func prepareCommand(cmd *exec.Cmd) *childProcess {
+	return &childProcess{cmd: cmd}
+}
+
+// signal does nothing on Windows: console control events already reach the command,
+// and other signals cannot be sent.
+func (c *childProcess) signal(s os.Signal) bool {
+	return false
+}
+
+func (c *childProcess) kill() {
+	c.cmd.Process.Kill()
+}
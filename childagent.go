@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// errChildAgentRestricted is returned by a restricted child agent for operations other than listing and signing.
+var errChildAgentRestricted = errors.New("agent: operation not permitted (-child-agent-restricted)")
+
+// childAgent is the ssh-agent served to the command (-child-agent). It holds the keys offered
+// to the ssh server, which are listed anew for each request, and (unless restricted) keys added
+// by the command. The keys offered to the ssh server cannot be removed.
+type childAgent struct {
+	keys *authKeys
+	// added holds the keys added by the command. It is nil if the agent is restricted.
+	added agent.ExtendedAgent
+
+	mu     sync.Mutex
+	locked bool
+}
+
+// newChildAgent returns a child agent for the given keys.
+// If restricted is set, it only allows listing keys and signing.
+func newChildAgent(keys *authKeys, restricted bool) *childAgent {
+	a := &childAgent{keys: keys}
+	if !restricted {
+		a.added = agent.NewKeyring().(agent.ExtendedAgent)
+	}
+	return a
+}
+
+// serveChildAgent serves the agent on a socket in a private temporary directory,
+// and returns the socket path. Only connections from the invoking user are accepted.
+func serveChildAgent(a agent.Agent) (string, error) {
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		return "", fmt.Errorf("create socket directory: %v", err)
+	}
+	state.cleanup = append(state.cleanup, func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "agent.sock")
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		return "", fmt.Errorf("listen on unix://%s: %v", path, err)
+	}
+	listener = &peerCheckListener{Listener: listener, uid: -1, gid: -1}
+	state.cleanup = append(state.cleanup, func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(a, conn)
+			}()
+		}
+	}()
+	return path, nil
+}
+
+func (a *childAgent) isLocked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.locked
+}
+
+func (a *childAgent) List() ([]*agent.Key, error) {
+	if a.isLocked() {
+		return nil, nil
+	}
+	signers, err := a.keys.Signers()
+	if err != nil {
+		return nil, err
+	}
+	var keys []*agent.Key
+	for _, signer := range signers {
+		publicKey := signer.PublicKey()
+		keys = append(keys, &agent.Key{Format: publicKey.Type(), Blob: publicKey.Marshal(), Comment: appName})
+	}
+	if a.added != nil {
+		added, err := a.added.List()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, added...)
+	}
+	return keys, nil
+}
+
+func (a *childAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *childAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if a.isLocked() {
+		return nil, errors.New("agent: locked")
+	}
+	signers, err := a.keys.Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		if !bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+			continue
+		}
+		if flags == 0 {
+			return signer.Sign(rand.Reader, data)
+		}
+		var algorithm string
+		switch flags {
+		case agent.SignatureFlagRsaSha256:
+			algorithm = ssh.SigAlgoRSASHA2256
+		case agent.SignatureFlagRsaSha512:
+			algorithm = ssh.SigAlgoRSASHA2512
+		default:
+			return nil, fmt.Errorf("agent: unsupported signature flags: %d", flags)
+		}
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+			return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+		}
+		// Keys held by the ssh-agent are asked to sign using the flags instead.
+		if a.keys.agent == nil {
+			return nil, fmt.Errorf("agent: key does not support signature algorithm %s", algorithm)
+		}
+		client, err := a.keys.agent.Client()
+		if err != nil {
+			return nil, err
+		}
+		if cert, ok := asCertificate(key); ok {
+			key = cert.Key
+		}
+		return client.SignWithFlags(key, data, flags)
+	}
+	if a.added != nil {
+		return a.added.SignWithFlags(key, data, flags)
+	}
+	return nil, errors.New("agent: key not found")
+}
+
+func (a *childAgent) Signers() ([]ssh.Signer, error) {
+	if a.isLocked() {
+		return nil, nil
+	}
+	signers, err := a.keys.Signers()
+	if err != nil {
+		return nil, err
+	}
+	if a.added != nil {
+		added, err := a.added.Signers()
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, added...)
+	}
+	return signers, nil
+}
+
+func (a *childAgent) Add(key agent.AddedKey) error {
+	if a.added == nil {
+		return errChildAgentRestricted
+	}
+	return a.added.Add(key)
+}
+
+func (a *childAgent) Remove(key ssh.PublicKey) error {
+	if a.added == nil {
+		return errChildAgentRestricted
+	}
+	return a.added.Remove(key)
+}
+
+func (a *childAgent) RemoveAll() error {
+	if a.added == nil {
+		return errChildAgentRestricted
+	}
+	return a.added.RemoveAll()
+}
+
+func (a *childAgent) Lock(passphrase []byte) error {
+	if a.added == nil {
+		return errChildAgentRestricted
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.added.Lock(passphrase); err != nil {
+		return err
+	}
+	a.locked = true
+	return nil
+}
+
+func (a *childAgent) Unlock(passphrase []byte) error {
+	if a.added == nil {
+		return errChildAgentRestricted
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.added.Unlock(passphrase); err != nil {
+		return err
+	}
+	a.locked = false
+	return nil
+}
+
+func (a *childAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
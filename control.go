@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// controlMasterEnvVar marks the re-executed control master process.
+const controlMasterEnvVar = "WITH_SSH_DOCKER_SOCKET_CONTROL_MASTER"
+
+// controlStartTimeout is how long a new control master waits for its first client.
+const controlStartTimeout = 10 * time.Second
+
+// errControlMasterRunning is returned by listenControl if another master serves the control socket.
+var errControlMasterRunning = errors.New("control master already running")
+
+// controlHello is sent by the control master to each client.
+type controlHello struct {
+	PID        int    `json:"pid"`
+	DockerHost string `json:"dockerHost"`
+	// AuthSock is the socket of the master's -child-agent, if any.
+	AuthSock string `json:"authSock,omitempty"`
+	// Hooks are the master's options that check and record the Docker API requests (see controlHooks).
+	Hooks string `json:"hooks,omitempty"`
+}
+
+// controlHooks returns the -policy-file, -authz-plugin and -audit-log options, which the
+// invocations sharing a control master must agree on.
+func controlHooks() string {
+	var options []string
+	if flags.PolicyFile != "" {
+		options = append(options, "-policy-file="+absPath(flags.PolicyFile))
+	}
+	for _, plugin := range flags.AuthzPlugins {
+		options = append(options, "-authz-plugin="+plugin)
+	}
+	if flags.AuditLog != "" {
+		options = append(options, "-audit-log="+absPath(flags.AuditLog))
+	}
+	return strings.Join(options, " ")
+}
+
+// absPath returns the absolute path of p, or p if it cannot be determined.
+func absPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+// controlPath returns the path of the control socket, which is keyed by the resolved hosts
+// (user@hostname:port of the jump hosts and the target), the transport, the remote socket,
+// the listen address, and the controlHooks.
+func controlPath() (string, error) {
+	if flags.ControlPath != "" {
+		return flags.ControlPath, nil
+	}
+	dir, err := userStateDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(controlKey()))
+	return filepath.Join(dir, fmt.Sprintf("control-%x.sock", sum[:8])), nil
+}
+
+func controlKey() string {
+	var chain []string
+	for _, host := range configuredHosts() {
+		chain = append(chain, fmt.Sprintf("%s@%s", host.User, host.Addr()))
+	}
+	return fmt.Sprintf("%s %s %s %s %s", strings.Join(chain, ","), flags.Transport, flags.RemoteSocketAddr, state.listenAddr, controlHooks())
+}
+
+// useControlMaster makes this invocation a client of the control master for the control path,
+// starting a master in the background if none is running.
+func useControlMaster() {
+	path, err := controlPath()
+	if err != nil {
+		fatalTunnelf("tunnel setup failed: %v", err)
+	}
+	conn, hello, err := dialControl(path)
+	if err != nil {
+		if flags.Verbose {
+			log.Printf("starting control master on %s", path)
+		}
+		var ready controlHello
+		// The control master exits with status 0 if another one has started in the meantime.
+		exitCode, err := startBackground(controlMasterEnvVar, &ready)
+		switch {
+		case err != nil && exitCode > 0:
+			os.Exit(exitCode)
+		case err != nil && exitCode < 0:
+			fatalTunnelf("tunnel setup failed: %v", err)
+		}
+		conn, hello, err = dialControl(path)
+		if err != nil {
+			fatalTunnelf("tunnel connection failed: control master: %v", err)
+		}
+	}
+	if hooks := controlHooks(); hello.Hooks != hooks {
+		conn.Close()
+		fatalTunnelf("tunnel setup failed: the control master (pid %d) on %s uses the options %q instead of %q; use another -control-path", hello.PID, path, hello.Hooks, hooks)
+	}
+	if flags.Verbose {
+		log.Printf("using shared tunnel of control master (pid %d)", hello.PID)
+	}
+	state.dockerHost = hello.DockerHost
+	if flags.ChildAgent {
+		if hello.AuthSock == "" {
+			log.Printf("warning: the control master (pid %d) does not serve a -child-agent", hello.PID)
+		}
+		state.childAgentSock = hello.AuthSock
+	}
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		tunnelFailed(fmt.Errorf("control master (pid %d) exited", hello.PID))
+	}()
+}
+
+// dialControl connects to the control master and reads its hello message.
+// The connection is the client's reference to the shared tunnel, and must be held open while it is used.
+func dialControl(path string) (net.Conn, *controlHello, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read from control socket: %v", err)
+	}
+	var hello controlHello
+	if err := json.Unmarshal(line, &hello); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read from control socket: %v", err)
+	}
+	return conn, &hello, nil
+}
+
+// listenControl listens on the control socket, replacing a stale socket file.
+// Only connections from the invoking user are accepted.
+func listenControl(path string) (net.Listener, error) {
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		if conn, errDial := net.Dial("unix", path); errDial == nil {
+			conn.Close()
+			return nil, errControlMasterRunning
+		}
+		os.Remove(path)
+		listener, err = listenUnix(path, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen on control socket: %v", err)
+	}
+	return &peerCheckListener{Listener: listener, uid: -1, gid: -1}, nil
+}
+
+// runControlMaster is the control master process started by useControlMaster. It serves the
+// tunnel until the last client has disconnected and the -control-persist time has passed.
+func runControlMaster(signals <-chan os.Signal) int {
+	hello := controlHello{PID: os.Getpid(), DockerHost: state.dockerHost, AuthSock: state.childAgentSock, Hooks: controlHooks()}
+	helloJSON, err := json.Marshal(hello)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return 1
+	}
+	if err := detachOutput(hello); err != nil {
+		log.Printf("error: %v", err)
+		return 1
+	}
+	clients := make(chan int)
+	go func() {
+		for {
+			conn, err := state.controlListener.Accept()
+			if err != nil {
+				return
+			}
+			clients <- 1
+			go func() {
+				defer func() { clients <- -1 }()
+				defer conn.Close()
+				if _, err := conn.Write(append(helloJSON, '\n')); err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	idle := time.NewTimer(controlStartTimeout)
+	refs := 0
+	for {
+		select {
+		case delta := <-clients:
+			refs += delta
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			if refs == 0 {
+				log.Printf("last client disconnected")
+				idle.Reset(flags.ControlPersist)
+			}
+		case <-idle.C:
+			log.Printf("no clients, shutting down")
+			return 0
+		case s := <-signals:
+			log.Printf("received %v signal, shutting down", s)
+			return 0
+		case err := <-state.tunnelErr:
+			log.Printf("tunnel connection failed: %v", err)
+			return exitCodeTunnelFailure
+		}
+	}
+}
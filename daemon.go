@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// daemonPIDEnvVar is the environment variable holding the PID of a background instance.
+	daemonPIDEnvVar = "WITH_SSH_DOCKER_SOCKET_PID"
+	// daemonChildEnvVar marks the re-executed background process.
+	daemonChildEnvVar = "WITH_SSH_DOCKER_SOCKET_DAEMON"
+)
+
+const (
+	exportFormatSh         = "sh"
+	exportFormatFish       = "fish"
+	exportFormatPowerShell = "powershell"
+	exportFormatJSON       = "json"
+)
+
+// daemonState is the content of the state file of a background instance.
+type daemonState struct {
+	PID          int       `json:"pid"`
+	EnvVarName   string    `json:"envVarName"`
+	DockerHost   string    `json:"dockerHost"`
+	AuthSock     string    `json:"authSock,omitempty"`
+	SSHAddr      string    `json:"sshAddr"`
+	RemoteSocket string    `json:"remoteSocket"`
+	PIDFile      string    `json:"pidFile"`
+	StateFile    string    `json:"stateFile"`
+	Started      time.Time `json:"started"`
+}
+
+// daemonFiles returns the pid file and state file paths of the instance for -a.
+// Unless given via -pid-file and -state-file, they are placed in a per-user directory.
+func daemonFiles() (pidFile, stateFile string, err error) {
+	pidFile, stateFile = flags.DaemonPIDFile, flags.DaemonStateFile
+	if pidFile != "" && stateFile != "" {
+		return pidFile, stateFile, nil
+	}
+	dir, err := userStateDir()
+	if err != nil {
+		return "", "", err
+	}
+	name := regexp.MustCompile(`[^A-Za-z0-9@._-]`).ReplaceAllString(flags.SSHAddr, "_")
+	if pidFile == "" {
+		pidFile = filepath.Join(dir, name+".pid")
+	}
+	if stateFile == "" {
+		stateFile = filepath.Join(dir, name+".json")
+	}
+	return pidFile, stateFile, nil
+}
+
+// userStateDir returns the per-user directory for pid, state and control socket files,
+// creating it if necessary.
+func userStateDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", appName, os.Getuid()))
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		dir = filepath.Join(runtimeDir, appName)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("create state directory: %v", err)
+	}
+	return dir, nil
+}
+
+func readPIDFile(path string) (int, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %v", path, err)
+	}
+	return pid, nil
+}
+
+// startDaemon re-executes the program in the background, waits until the tunnel is ready,
+// prints the environment variables to set, and exits.
+func startDaemon() {
+	if flag.NArg() > 0 {
+		log.Fatal("error: no command may be given with -daemon")
+	}
+	if err := checkExportFormat(); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	pidFile, _, err := daemonFiles()
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if pid, err := readPIDFile(pidFile); err == nil && processAlive(pid) {
+		log.Fatalf("error: already running (pid %d, see %s); stop it using -kill", pid, pidFile)
+	}
+	var daemon daemonState
+	if exitCode, err := startBackground(daemonChildEnvVar, &daemon); err != nil {
+		if exitCode > 0 {
+			os.Exit(exitCode)
+		}
+		fatalTunnelf("%v", err)
+	}
+	values := map[string]string{
+		daemon.EnvVarName: daemon.DockerHost,
+		daemonPIDEnvVar:   strconv.Itoa(daemon.PID),
+	}
+	names := []string{daemon.EnvVarName, daemonPIDEnvVar}
+	if daemon.AuthSock != "" {
+		values["SSH_AUTH_SOCK"] = daemon.AuthSock
+		names = append(names, "SSH_AUTH_SOCK")
+	}
+	printEnv(os.Stdout, values, names)
+	os.Exit(0)
+}
+
+// backgroundMessage is a message from a background process to the process that started it
+// (see startBackground): a prompt to relay to the user, or the report of its readiness.
+type backgroundMessage struct {
+	Prompt *promptRequest  `json:"prompt,omitempty"`
+	Ready  json.RawMessage `json:"ready,omitempty"`
+}
+
+// startBackground re-executes the program in the background with the given marker variable set,
+// and waits until it reports readiness by writing the JSON value ready to stdout (see detachOutput).
+// Until then, its prompts (e.g. for passphrases and passwords) are relayed to the user, since the
+// background process has no terminal. If it exits instead, its exit code is returned along with an
+// error, or -1 if it could not be started.
+func startBackground(markerEnvVar string, ready interface{}) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return -1, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), markerEnvVar+"=1")
+	if canPrompt() {
+		cmd.Env = append(cmd.Env, promptRelayEnvVar+"=1")
+	}
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = daemonSysProcAttr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return -1, err
+	}
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("start background process: %v", err)
+	}
+	messages := json.NewDecoder(stdout)
+	for {
+		var message backgroundMessage
+		if err := messages.Decode(&message); err != nil {
+			stdin.Close()
+			cmd.Wait()
+			return cmd.ProcessState.ExitCode(), fmt.Errorf("background process exited before becoming ready")
+		}
+		if message.Prompt != nil {
+			answerPrompt(stdin, message.Prompt)
+			continue
+		}
+		go cmd.Wait()
+		return 0, json.Unmarshal(message.Ready, ready)
+	}
+}
+
+// detachOutput reports readiness to startBackground by writing ready to stdout, stops relaying
+// prompts, and redirects further output to the -log-file (or discards it).
+func detachOutput(ready interface{}) error {
+	readyJSON, err := json.Marshal(ready)
+	if err != nil {
+		return err
+	}
+	promptMu.Lock()
+	relay = nil
+	json.NewEncoder(os.Stdout).Encode(backgroundMessage{Ready: readyJSON})
+	promptMu.Unlock()
+	os.Stdout.Close()
+	os.Stdin.Close()
+	var logOutput io.Writer = ioutil.Discard
+	if flags.DaemonLogFile != "" {
+		f, err := os.OpenFile(flags.DaemonLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("open log file: %v", err)
+		}
+		state.cleanup = append(state.cleanup, func() { f.Close() })
+		os.Stderr = f
+		logOutput = f
+	} else if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stderr = devNull
+	}
+	log.SetOutput(logOutput)
+	return nil
+}
+
+// runDaemon is the background process started by startDaemon. It writes the pid file and
+// state file, reports readiness on stdout, and then serves the tunnel until it receives a
+// signal or the tunnel fails.
+func runDaemon(signals <-chan os.Signal) int {
+	pidFile, stateFile, err := daemonFiles()
+	if err != nil {
+		log.Printf("error: %v", err)
+		return 1
+	}
+	daemon := daemonState{
+		PID:          os.Getpid(),
+		EnvVarName:   flags.EnvVarName,
+		DockerHost:   state.dockerHost,
+		AuthSock:     state.childAgentSock,
+		SSHAddr:      flags.SSHAddr,
+		RemoteSocket: flags.RemoteSocketAddr,
+		PIDFile:      pidFile,
+		StateFile:    stateFile,
+		Started:      time.Now(),
+	}
+	stateJSON, err := json.MarshalIndent(daemon, "", "  ")
+	if err != nil {
+		log.Printf("error: %v", err)
+		return 1
+	}
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintln(daemon.PID)), 0600); err != nil {
+		log.Printf("error: write pid file: %v", err)
+		return 1
+	}
+	state.cleanup = append(state.cleanup, func() { os.Remove(pidFile) })
+	if err := ioutil.WriteFile(stateFile, append(stateJSON, '\n'), 0600); err != nil {
+		log.Printf("error: write state file: %v", err)
+		return 1
+	}
+	state.cleanup = append(state.cleanup, func() { os.Remove(stateFile) })
+	if flags.Verbose {
+		log.Printf("running in the background (pid %d, state file %s)", daemon.PID, stateFile)
+	}
+
+	if err := detachOutput(daemon); err != nil {
+		log.Printf("error: %v", err)
+		return 1
+	}
+
+	select {
+	case s := <-signals:
+		log.Printf("received %v signal, shutting down", s)
+		return 0
+	case err := <-state.tunnelErr:
+		log.Printf("tunnel connection failed: %v", err)
+		return exitCodeTunnelFailure
+	}
+}
+
+// killDaemon stops the background instance given by -pid-file, -a or $WITH_SSH_DOCKER_SOCKET_PID,
+// and prints the commands to unset its environment variables.
+func killDaemon() {
+	if err := checkExportFormat(); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	envVarName := flags.EnvVarName
+	var authSock bool
+	var pid int
+	var pidFile, stateFile string
+	if flags.SSHAddr != "" || flags.DaemonPIDFile != "" {
+		var err error
+		pidFile, stateFile, err = daemonFiles()
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		pid, err = readPIDFile(pidFile)
+		if err != nil {
+			log.Fatalf("error: no running instance found: %v", err)
+		}
+		if buf, err := ioutil.ReadFile(stateFile); err == nil {
+			var daemon daemonState
+			if err := json.Unmarshal(buf, &daemon); err == nil && daemon.EnvVarName != "" {
+				envVarName = daemon.EnvVarName
+				authSock = daemon.AuthSock != ""
+			}
+		}
+	} else {
+		value, ok := os.LookupEnv(daemonPIDEnvVar)
+		if !ok {
+			log.Fatalf("error: no instance to kill (-kill needs -a, -pid-file, or $%s)", daemonPIDEnvVar)
+		}
+		var err error
+		if pid, err = strconv.Atoi(value); err != nil {
+			log.Fatalf("error: invalid $%s: %v", daemonPIDEnvVar, err)
+		}
+		daemon, err := findDaemonState(pid)
+		if err != nil {
+			log.Fatalf("error: pid %d from $%s is not a background instance: %v (use -a or -pid-file)", pid, daemonPIDEnvVar, err)
+		}
+		envVarName, authSock = daemon.EnvVarName, daemon.AuthSock != ""
+		pidFile, stateFile = daemon.PIDFile, daemon.StateFile
+	}
+	if processAlive(pid) && !isDaemonProcess(pid) {
+		log.Printf("warning: pid %d is not a background instance of %s (the pid file is stale), not stopping it", pid, appName)
+	} else if processAlive(pid) {
+		if err := terminateProcess(pid); err != nil {
+			log.Fatalf("error: stop pid %d: %v", pid, err)
+		}
+		deadline := time.Now().Add(flags.KillGracePeriod)
+		for processAlive(pid) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if processAlive(pid) {
+			log.Printf("pid %d did not exit within %v, killing it", pid, flags.KillGracePeriod)
+			killProcess(pid)
+		}
+	} else {
+		log.Printf("warning: pid %d is not running", pid)
+	}
+	for _, path := range []string{pidFile, stateFile} {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+	names := []string{envVarName, daemonPIDEnvVar}
+	if authSock {
+		names = append(names, "SSH_AUTH_SOCK")
+	}
+	printEnv(os.Stdout, nil, names)
+}
+
+// findDaemonState returns the state of the background instance with the given pid,
+// from its state file in the per-user directory.
+func findDaemonState(pid int) (*daemonState, error) {
+	dir, err := userStateDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var daemon daemonState
+		if json.Unmarshal(buf, &daemon) == nil && daemon.PID == pid && daemon.StateFile == path {
+			return &daemon, nil
+		}
+	}
+	return nil, fmt.Errorf("no state file with this pid in %s", dir)
+}
+
+func checkExportFormat() error {
+	switch flags.ExportFormat {
+	case exportFormatSh, exportFormatFish, exportFormatPowerShell, exportFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q (supported: %s, %s, %s, %s)", flags.ExportFormat, exportFormatSh, exportFormatFish, exportFormatPowerShell, exportFormatJSON)
+}
+
+// printEnv prints commands that set the given environment variables in the -export-format.
+// Variables without a value are unset.
+func printEnv(w io.Writer, values map[string]string, names []string) {
+	if flags.ExportFormat == exportFormatJSON {
+		object := make(map[string]*string, len(names))
+		for _, name := range names {
+			if value, ok := values[name]; ok {
+				object[name] = &value
+			} else {
+				object[name] = nil
+			}
+		}
+		json.NewEncoder(w).Encode(object)
+		return
+	}
+	for _, name := range names {
+		value, ok := values[name]
+		switch {
+		case flags.ExportFormat == exportFormatFish && ok:
+			fmt.Fprintf(w, "set -gx %s %s;\n", name, quoteFish(value))
+		case flags.ExportFormat == exportFormatFish:
+			fmt.Fprintf(w, "set -e %s;\n", name)
+		case flags.ExportFormat == exportFormatPowerShell && ok:
+			fmt.Fprintf(w, "$env:%s = %s\n", name, quotePowerShell(value))
+		case flags.ExportFormat == exportFormatPowerShell:
+			fmt.Fprintf(w, "Remove-Item Env:%s -ErrorAction SilentlyContinue\n", name)
+		case ok:
+			fmt.Fprintf(w, "%s=%s; export %s;\n", name, quoteSh(value), name)
+		default:
+			fmt.Fprintf(w, "unset %s;\n", name)
+		}
+	}
+}
+
+func quoteSh(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func quoteFish(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func quotePowerShell(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+)
+
+// isDaemonProcess returns whether the process is a background instance started by startDaemon,
+// i.e. whether its environment has the daemonChildEnvVar marker.
+func isDaemonProcess(pid int) bool {
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return false
+	}
+	for _, entry := range bytes.Split(environ, []byte{0}) {
+		if string(entry) == daemonChildEnvVar+"=1" {
+			return true
+		}
+	}
+	return false
+}
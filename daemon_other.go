@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// isDaemonProcess cannot check the process on this platform, and relies on the pid and state files.
+func isDaemonProcess(pid int) bool {
+	return true
+}
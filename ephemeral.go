@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sgreben/sshtunnel"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ephemeralClockSkew is how far into the past the validity of ephemeral certificates starts,
+// to allow for clock differences between the local and remote hosts.
+const ephemeralClockSkew = time.Minute
+
+// defaultEphemeralExtensions are the certificate extensions used if none are given via -ssh-cert-extension.
+var defaultEphemeralExtensions = []string{"permit-port-forwarding"}
+
+// ephemeralKey is an in-memory key that is certified by a local CA.
+// The certificate is short-lived, and is renewed when connecting after half its validity has passed.
+type ephemeralKey struct {
+	key        ssh.Signer
+	ca         func() (ssh.Signer, error)
+	validity   time.Duration
+	principals []string
+	extensions map[string]string
+
+	mu      sync.Mutex
+	cert    ssh.Signer
+	renewAt time.Time
+}
+
+// newEphemeralKey generates an ephemeral ed25519 key, to be certified using the CA key at caPath
+// (or, if useAgent is set, the ssh-agent key whose public key is at caPath).
+func newEphemeralKey(caPath string, useAgent bool, validity time.Duration, principals, extensions []string) (*ephemeralKey, error) {
+	if validity <= 0 {
+		return nil, errors.New("certificate validity must be positive")
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	k := &ephemeralKey{
+		key:        key,
+		validity:   validity,
+		principals: principals,
+		extensions: make(map[string]string),
+	}
+	for _, extension := range extensions {
+		name, value := extension, ""
+		if i := strings.IndexByte(extension, '='); i >= 0 {
+			name, value = extension[:i], extension[i+1:]
+		}
+		k.extensions[name] = value
+	}
+	if useAgent {
+		caPublicKey, err := readPublicKeyFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("read CA public key: %v", err)
+		}
+		k.ca = func() (ssh.Signer, error) {
+			return agentCA(caPublicKey)
+		}
+	} else {
+		ca, err := keySigner(sshtunnel.KeySource{Path: &caPath}, caPath, true)
+		if err != nil {
+			return nil, fmt.Errorf("read CA key: %v", err)
+		}
+		ca = rsaSHA2Signer(ca)
+		k.ca = func() (ssh.Signer, error) {
+			return ca, nil
+		}
+	}
+	if _, err := k.Signer(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Signer returns the key, together with a currently valid certificate.
+func (k *ephemeralKey) Signer() (ssh.Signer, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if k.cert != nil && now.Before(k.renewAt) {
+		return k.cert, nil
+	}
+	ca, err := k.ca()
+	if err != nil {
+		return nil, fmt.Errorf("CA key: %v", err)
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	hostName, _ := os.Hostname()
+	cert := &ssh.Certificate{
+		Key:             k.key.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("%s %s@%s", appName, os.Getenv("USER"), hostName),
+		ValidPrincipals: k.principals,
+		ValidAfter:      uint64(now.Add(-ephemeralClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(k.validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: k.extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, fmt.Errorf("sign certificate: %v", err)
+	}
+	signer, err := ssh.NewCertSigner(cert, k.key)
+	if err != nil {
+		return nil, err
+	}
+	if flags.Verbose {
+		log.Printf("signed ephemeral certificate %s (serial %d), valid until %s", ssh.FingerprintSHA256(k.key.PublicKey()), cert.Serial, certificateTime(cert.ValidBefore))
+	}
+	k.cert = signer
+	k.renewAt = now.Add(k.validity / 2)
+	return signer, nil
+}
+
+// agentCA returns a signer for the ssh-agent key with the given public key.
+func agentCA(publicKey ssh.PublicKey) (ssh.Signer, error) {
+	if flags.SSHAuthSocketAddr == "" {
+		return nil, errors.New("no ssh-agent ($SSH_AUTH_SOCK is not set)")
+	}
+	sshAgent := openAgent(flags.SSHAuthSocketAddr)
+	keys, err := sshAgent.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if string(key.PublicKey().Marshal()) != string(publicKey.Marshal()) {
+			continue
+		}
+		client, err := sshAgent.Client()
+		if err != nil {
+			return nil, err
+		}
+		return &certAuthority{
+			publicKey: publicKey,
+			sign: func(data []byte) (*ssh.Signature, error) {
+				var signFlags agent.SignatureFlags
+				if publicKey.Type() == ssh.KeyAlgoRSA {
+					signFlags = agent.SignatureFlagRsaSha512
+				}
+				return client.SignWithFlags(publicKey, data, signFlags)
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("ssh-agent does not hold the CA key %s", ssh.FingerprintSHA256(publicKey))
+}
+
+// rsaSHA2Signer makes RSA signers sign using rsa-sha2-512 rather than (deprecated) ssh-rsa.
+func rsaSHA2Signer(signer ssh.Signer) ssh.Signer {
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok || signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer
+	}
+	return &certAuthority{
+		publicKey: signer.PublicKey(),
+		sign: func(data []byte) (*ssh.Signature, error) {
+			return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+		},
+	}
+}
+
+// certAuthority is a signer for certificates.
+type certAuthority struct {
+	publicKey ssh.PublicKey
+	sign      func(data []byte) (*ssh.Signature, error)
+}
+
+func (a *certAuthority) PublicKey() ssh.PublicKey {
+	return a.publicKey
+}
+
+func (a *certAuthority) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return a.sign(data)
+}
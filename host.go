@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgreben/sshtunnel"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshHost is the resolved configuration of an SSH server.
+type sshHost struct {
+	Alias    string
+	User     string
+	HostName string
+	Port     string
+
+	IdentityFiles    []string
+	CertificateFiles []string
+	IdentitiesOnly   bool
+	IdentityAgent    string
+
+	Password                     *string
+	PasswordAuthentication       bool
+	KbdInteractiveAuthentication bool
+	NumberOfPasswordPrompts      int
+	BatchMode                    bool
+
+	ProxyJump    []string
+	ProxyCommand string
+	ControlPath  string
+
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+
+	KnownHostsFiles     []string
+	HostKeyFingerprints []string
+	HostKeyTOFU         bool
+	HostKeyInsecure     bool
+}
+
+// sshHostSpec is a [user@]host[:port] server address, as given on the command line or via ProxyJump.
+type sshHostSpec struct {
+	User string
+	Host string
+	Port string
+}
+
+func parseSSHHostSpec(addr string) sshHostSpec {
+	var spec sshHostSpec
+	addr = strings.TrimPrefix(addr, "ssh://")
+	spec.Host = addr
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		spec.User, spec.Host = addr[:i], addr[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(spec.Host); err == nil {
+		spec.Host, spec.Port = host, port
+	}
+	return spec
+}
+
+func (s sshHostSpec) String() string {
+	addr := s.Host
+	if s.Port != "" {
+		addr = net.JoinHostPort(s.Host, s.Port)
+	}
+	if s.User != "" {
+		addr = s.User + "@" + addr
+	}
+	return addr
+}
+
+// resolveSSHHost resolves the given server address using the ssh_config.
+// User and port given in the address, as well as the -known-hosts-file flag,
+// take precedence over the ssh_config.
+func resolveSSHHost(config *sshConfig, spec sshHostSpec) sshHost {
+	alias := spec.Host
+	host := sshHost{
+		Alias:          alias,
+		User:           config.GetString(alias, "user"),
+		HostName:       config.GetString(alias, "hostname"),
+		Port:           config.GetString(alias, "port"),
+		IdentitiesOnly: strings.EqualFold(config.GetString(alias, "identitiesonly"), "yes"),
+		IdentityAgent:  config.GetString(alias, "identityagent"),
+	}
+	if spec.User != "" {
+		host.User = spec.User
+	}
+	if host.User == "" {
+		host.User = os.Getenv("USER")
+	}
+	if spec.Port != "" {
+		host.Port = spec.Port
+	}
+	if host.Port == "" {
+		host.Port = "22"
+	}
+	if host.HostName != "" {
+		// In HostName, %h is the alias, as the host name is not known yet.
+		host.HostName = host.expandTokensForHost(host.HostName, alias)
+	} else {
+		host.HostName = alias
+	}
+	for _, path := range config.GetAll(alias, "identityfile") {
+		host.IdentityFiles = append(host.IdentityFiles, expandTilde(host.expandTokens(path)))
+	}
+	for _, path := range config.GetAll(alias, "certificatefile") {
+		host.CertificateFiles = append(host.CertificateFiles, expandTilde(host.expandTokens(path)))
+	}
+	if proxyJump := config.GetString(alias, "proxyjump"); proxyJump != "" && proxyJump != "none" {
+		host.ProxyJump = strings.Split(proxyJump, ",")
+	}
+	if proxyCommand := config.GetRaw(alias, "proxycommand"); proxyCommand != "" && proxyCommand != "none" {
+		host.ProxyCommand = host.expandTokens(proxyCommand)
+	}
+	host.PasswordAuthentication = !strings.EqualFold(config.GetString(alias, "passwordauthentication"), "no")
+	kbdInteractive := config.GetString(alias, "kbdinteractiveauthentication")
+	if kbdInteractive == "" {
+		kbdInteractive = config.GetString(alias, "challengeresponseauthentication")
+	}
+	host.KbdInteractiveAuthentication = !strings.EqualFold(kbdInteractive, "no")
+	host.NumberOfPasswordPrompts = 3
+	if count, err := strconv.Atoi(config.GetString(alias, "numberofpasswordprompts")); err == nil {
+		host.NumberOfPasswordPrompts = count
+	}
+	host.BatchMode = strings.EqualFold(config.GetString(alias, "batchmode"), "yes")
+	if controlPath := config.GetString(alias, "controlpath"); controlPath != "" && controlPath != "none" {
+		host.ControlPath = expandTilde(host.expandTokens(controlPath))
+	}
+	if seconds, err := strconv.Atoi(config.GetString(alias, "serveraliveinterval")); err == nil {
+		host.ServerAliveInterval = time.Duration(seconds) * time.Second
+	}
+	host.ServerAliveCountMax = 3
+	if count, err := strconv.Atoi(config.GetString(alias, "serveralivecountmax")); err == nil {
+		host.ServerAliveCountMax = count
+	}
+	host.HostKeyInsecure = flags.HostKeyInsecure
+	host.HostKeyTOFU = flags.HostKeyTOFU
+	switch strings.ToLower(config.GetString(alias, "stricthostkeychecking")) {
+	case "no", "off":
+		host.HostKeyInsecure = true
+	case "accept-new":
+		host.HostKeyTOFU = true
+	}
+	host.KnownHostsFiles = flags.KnownHostsFiles
+	if userKnownHostsFiles := config.Get(alias, "userknownhostsfile"); userKnownHostsFiles != nil && !flagsSet["known-hosts-file"] {
+		host.KnownHostsFiles = nil
+		for _, path := range userKnownHostsFiles {
+			if path != "none" {
+				host.KnownHostsFiles = append(host.KnownHostsFiles, expandTilde(host.expandTokens(path)))
+			}
+		}
+		host.KnownHostsFiles = append(host.KnownHostsFiles, globalKnownHostsFile)
+	}
+	return host
+}
+
+// expandTokens expands the ssh_config(5) tokens %%, %C, %d, %h, %L, %l, %n, %p, %r and %u.
+func (h sshHost) expandTokens(s string) string {
+	hostName := h.HostName
+	if hostName == "" {
+		hostName = h.Alias
+	}
+	return h.expandTokensForHost(s, hostName)
+}
+
+// expandTokensForHost is expandTokens with %h (and the host name in %C) set to the given host name.
+func (h sshHost) expandTokensForHost(s, hostName string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	home, _ := os.UserHomeDir()
+	localHostName, _ := os.Hostname()
+	shortLocalHostName := localHostName
+	if i := strings.IndexByte(shortLocalHostName, '.'); i >= 0 {
+		shortLocalHostName = shortLocalHostName[:i]
+	}
+	connectionHash := sha1.Sum([]byte(localHostName + hostName + h.Port + h.User + strings.Join(h.ProxyJump, ",")))
+	return strings.NewReplacer(
+		"%%", "%",
+		"%C", hex.EncodeToString(connectionHash[:]),
+		"%d", home,
+		"%h", hostName,
+		"%L", shortLocalHostName,
+		"%l", localHostName,
+		"%n", h.Alias,
+		"%p", h.Port,
+		"%r", h.User,
+		"%u", os.Getenv("USER"),
+	).Replace(s)
+}
+
+// Addr returns the host:port address of the server.
+func (h sshHost) Addr() string {
+	return net.JoinHostPort(h.HostName, h.Port)
+}
+
+// TunnelConfig returns the sshtunnel.Config for a connection to the host, authenticating using the given keys.
+func (h sshHost) TunnelConfig(keys *authKeys) *sshtunnel.Config {
+	return &sshtunnel.Config{
+		SSHAddr: h.Addr(),
+		SSHClient: &ssh.ClientConfig{
+			User:            h.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(keys.Signers)},
+			HostKeyCallback: hostKeyCallback(h),
+		},
+	}
+}
+
+// Hop returns the configuration of a connection to the host as part of a jump host chain.
+func (h sshHost) Hop() (sshHop, error) {
+	keys, err := h.AuthKeys()
+	if err != nil {
+		return sshHop{}, fmt.Errorf("%s: %v", h.Alias, err)
+	}
+	hop := sshHop{
+		Config:        h.TunnelConfig(keys),
+		Keys:          keys,
+		AliveInterval: h.ServerAliveInterval,
+		AliveCountMax: h.ServerAliveCountMax,
+	}
+	if h.ProxyCommand != "" {
+		hop.Dial = proxyCommandDialer(h.ProxyCommand)
+	}
+	interactive, err := h.InteractiveAuth()
+	if err != nil {
+		return sshHop{}, fmt.Errorf("%s: %v", h.Alias, err)
+	}
+	hop.Interactive = interactive
+	return hop, nil
+}
+
+// authKeys are the keys offered to a host.
+// The ssh-agent's keys are listed anew for each connection attempt.
+type authKeys struct {
+	// keys are the keys loaded from files (and -ssh-key-env).
+	keys []ssh.Signer
+	// identities are the public keys of the -i key and the IdentityFiles.
+	identities []ssh.PublicKey
+	// certs are the certificates from CertificateFiles, and companion certificates of
+	// IdentityFiles whose key is held by the agent, to be used with matching agent keys.
+	certs []*ssh.Certificate
+
+	agent          *liveAgent
+	selector       agentKeySelector
+	identitiesOnly bool
+}
+
+// AuthKeys returns the keys to offer to the host.
+//
+// The ssh-agent's keys come first (unless IdentitiesOnly is set), followed by the key given
+// via -i (or -ssh-key-env), and the host's IdentityFiles. IdentityFiles that cannot be loaded
+// are skipped with a warning. Encrypted IdentityFiles whose key is available from the ssh-agent
+// are not decrypted, but their agent key is used; others are decrypted using a prompted passphrase.
+// If IdentitiesOnly is set, only those agent keys matching an identity file are offered;
+// if agent keys are selected via -ssh-agent-key, only those are offered.
+//
+// Keys are used with their certificate, if there is one: the companion certificate file of
+// the key file (e.g. id_ed25519-cert.pub), a CertificateFile, or a certificate held by the agent.
+func (h sshHost) AuthKeys() (*authKeys, error) {
+	keys := &authKeys{
+		agent:          h.agent(),
+		selector:       agentKeySelector(flags.SSHAgentKeys),
+		identitiesOnly: h.IdentitiesOnly,
+	}
+	var agentKeys []agentKey
+	if keys.agent != nil {
+		var err error
+		agentKeys, err = keys.agent.Keys()
+		if err != nil {
+			log.Printf("warning: skipping ssh-agent keys: %v", err)
+		}
+	}
+	var agentCerts []*ssh.Certificate
+	for _, key := range agentKeys {
+		if cert, ok := asCertificate(key.PublicKey()); ok {
+			if err := checkCertificate(cert); err != nil {
+				log.Printf("warning: skipping ssh-agent key: %v", err)
+				continue
+			}
+			agentCerts = append(agentCerts, cert)
+		}
+	}
+	for _, path := range h.CertificateFiles {
+		cert, err := readCertificateFile(path)
+		if err != nil {
+			log.Printf("warning: skipping certificate file %s: %v", path, err)
+			continue
+		}
+		if cert != nil {
+			keys.certs = append(keys.certs, cert)
+		}
+	}
+	certs := append(append([]*ssh.Certificate{}, keys.certs...), agentCerts...)
+	inAgent := func(publicKey ssh.PublicKey) bool {
+		for _, key := range agentKeys {
+			if string(key.PublicKey().Marshal()) == string(publicKey.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if state.sshKey != nil {
+		signer, err := certificateSigner(state.sshKey, flags.SSHKeyPath, certs)
+		if err != nil {
+			return nil, err
+		}
+		keys.keys = append(keys.keys, signer)
+		keys.identities = append(keys.identities, state.sshKey.PublicKey())
+	}
+	for _, path := range h.IdentityFiles {
+		buf, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("warning: skipping identity file %s: %v", path, err)
+			continue
+		}
+		publicKey, err := readPublicKeyFile(path + ".pub")
+		if err != nil {
+			publicKey = encryptedKeyPublicKey(buf)
+		}
+		if publicKey != nil {
+			keys.identities = append(keys.identities, publicKey)
+			if isEncryptedKey(buf) && inAgent(publicKey) {
+				cert, err := readCertificateFile(certificatePath(path))
+				if err != nil {
+					log.Printf("warning: identity file %s: %v", path, err)
+				} else if cert != nil {
+					keys.certs = append(keys.certs, cert)
+				}
+				continue
+			}
+		}
+		signer, err := keySigner(sshtunnel.KeySource{PEM: &buf}, path, !h.BatchMode)
+		if err != nil {
+			log.Printf("warning: skipping identity file %s: %v", path, err)
+			continue
+		}
+		keys.identities = append(keys.identities, signer.PublicKey())
+		if certSigner, err := certificateSigner(signer, path, certs); err != nil {
+			log.Printf("warning: identity file %s: %v", path, err)
+		} else {
+			signer = certSigner
+		}
+		keys.keys = append(keys.keys, signer)
+	}
+
+	if len(keys.selector) > 0 && keys.agent != nil {
+		selected := false
+		for _, key := range agentKeys {
+			selected = selected || keys.selector.Matches(key)
+		}
+		if !selected {
+			log.Printf("warning: no ssh-agent key matches -ssh-agent-key %s", strings.Join(keys.selector, ", "))
+		}
+	}
+	return keys, nil
+}
+
+// Signers returns the keys to offer for one connection attempt.
+func (k *authKeys) Signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if state.ephemeralKey != nil {
+		signer, err := state.ephemeralKey.Signer()
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	var agentSigners []ssh.Signer
+	if k.agent != nil {
+		agentKeys, err := k.agent.Keys()
+		if err != nil {
+			log.Printf("warning: skipping ssh-agent keys: %v", err)
+		}
+		for _, key := range agentKeys {
+			publicKey := key.PublicKey()
+			if cert, ok := asCertificate(publicKey); ok {
+				if checkCertificate(cert) != nil {
+					continue
+				}
+				publicKey = cert.Key
+			}
+			switch {
+			case len(k.selector) > 0:
+				if !k.selector.Matches(key) {
+					continue
+				}
+			case k.identitiesOnly:
+				if !containsPublicKey(k.identities, publicKey) {
+					continue
+				}
+			}
+			if _, ok := asCertificate(key.PublicKey()); !ok {
+				if certSigner, err := certificateSigner(key.Signer, "", k.certs); err == nil && certSigner != key.Signer {
+					agentSigners = append(agentSigners, certSigner)
+				}
+			}
+			agentSigners = append(agentSigners, key.Signer)
+		}
+	}
+	// Keys loaded from files are not offered again if the agent holds them.
+	var keys []ssh.Signer
+	for _, signer := range k.keys {
+		if !containsSigner(agentSigners, signer) {
+			keys = append(keys, signer)
+		}
+	}
+	if k.identitiesOnly || len(k.selector) > 0 {
+		return append(append(signers, keys...), agentSigners...), nil
+	}
+	return append(append(signers, agentSigners...), keys...), nil
+}
+
+// agent returns the ssh-agent for the host, or nil if no agent is to be used.
+func (h sshHost) agent() *liveAgent {
+	agentAddr := flags.SSHAuthSocketAddr
+	if !flagsSet["ssh-auth-sock"] && h.IdentityAgent != "" {
+		switch agent := h.IdentityAgent; {
+		case agent == "none":
+			agentAddr = ""
+		case agent == "SSH_AUTH_SOCK":
+		case strings.HasPrefix(agent, "$"):
+			agentAddr = os.Getenv(agent[1:])
+		default:
+			agentAddr = expandTilde(h.expandTokens(agent))
+		}
+	}
+	if agentAddr == "" {
+		return nil
+	}
+	return openAgent(agentAddr)
+}
+
+func containsPublicKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if string(k.Marshal()) == string(key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsSigner(signers []ssh.Signer, signer ssh.Signer) bool {
+	for _, s := range signers {
+		if string(s.PublicKey().Marshal()) == string(signer.PublicKey().Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func readPublicKeyFile(path string) (ssh.PublicKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	return publicKey, err
+}
+
+// sshHostChain resolves the given server address and its ProxyJump hosts.
+// If jumpHosts is non-empty, it replaces the server's ProxyJump setting.
+// The returned hosts are in connection order, with the given server last.
+func sshHostChain(config *sshConfig, spec sshHostSpec, jumpHosts []string) ([]sshHost, error) {
+	const maxHops = 16
+	var chain []sshHost
+	target := resolveSSHHost(config, spec)
+	if len(jumpHosts) > 0 {
+		target.ProxyJump = jumpHosts
+	}
+	for host := target; ; {
+		chain = append([]sshHost{host}, chain...)
+		if len(chain) > maxHops {
+			return nil, fmt.Errorf("too many ProxyJump hops for %s", spec)
+		}
+		if len(host.ProxyJump) == 0 {
+			break
+		}
+		// The jump hosts of a ProxyJump list connect in order; only the first may itself have a ProxyJump.
+		jumps := host.ProxyJump
+		for i := len(jumps) - 1; i > 0; i-- {
+			jump := resolveSSHHost(config, parseSSHHostSpec(jumps[i]))
+			jump.ProxyJump = nil
+			chain = append([]sshHost{jump}, chain...)
+		}
+		host = resolveSSHHost(config, parseSSHHostSpec(jumps[0]))
+	}
+	return chain, nil
+}
+
+// defaultSSHConfigFiles returns the user and system ssh_config paths.
+func defaultSSHConfigFiles() []string {
+	var paths []string
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".ssh", "config"))
+	}
+	return append(paths, "/etc/ssh/ssh_config")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyError is a host key verification failure.
+// Unlike other connection errors, it is never retried.
+type hostKeyError struct {
+	hostname string
+	key      ssh.PublicKey
+	reason   string
+}
+
+func (e *hostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s (%s %s): %s", e.hostname, e.key.Type(), ssh.FingerprintSHA256(e.key), e.reason)
+}
+
+const globalKnownHostsFile = "/etc/ssh/ssh_known_hosts"
+
+// hostKeyCallback returns the host key callback for the given host.
+func hostKeyCallback(host sshHost) ssh.HostKeyCallback {
+	switch {
+	case host.HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey()
+	case len(host.HostKeyFingerprints) > 0:
+		return hostKeyCallbackFingerprints(host.HostKeyFingerprints)
+	default:
+		return hostKeyCallbackKnownHosts(host.KnownHostsFiles, host.HostKeyTOFU)
+	}
+}
+
+// hostKeyCallbackFingerprints accepts only host keys with one of the given SHA256 fingerprints.
+// For host certificates, the fingerprint of the certified key is accepted as well.
+func hostKeyCallbackFingerprints(fingerprints []string) ssh.HostKeyCallback {
+	normalize := func(fingerprint string) string {
+		return strings.TrimRight(strings.TrimSpace(fingerprint), "=")
+	}
+	pinned := make(map[string]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		pinned[normalize(fingerprint)] = true
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if pinned[ssh.FingerprintSHA256(key)] {
+			return nil
+		}
+		if cert, ok := key.(*ssh.Certificate); ok && pinned[ssh.FingerprintSHA256(cert.Key)] {
+			return nil
+		}
+		return &hostKeyError{
+			hostname: hostname,
+			key:      key,
+			reason:   fmt.Sprintf("does not match pinned fingerprint %s", strings.Join(fingerprints, ", ")),
+		}
+	}
+}
+
+// hostKeyCallbackKnownHosts verifies host keys against the given known_hosts files.
+// Hashed host names and @cert-authority / @revoked markers are supported.
+//
+// The files are re-read on each call, so that keys added in the meantime are picked up.
+// If tofu is set, keys of unknown hosts are accepted and appended to the first file.
+func hostKeyCallbackKnownHosts(paths []string, tofu bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		var existing []string
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				existing = append(existing, path)
+			}
+		}
+		callback, err := knownhosts.New(existing...)
+		if err != nil {
+			return fmt.Errorf("read known_hosts: %v", err)
+		}
+		err = callback(hostname, remote, key)
+		if cert, ok := key.(*ssh.Certificate); ok && err == nil {
+			// The @revoked markers are only checked against the certificate itself. Like OpenSSH,
+			// also reject certificates of revoked keys, and those signed by revoked authorities.
+			for _, certKey := range []ssh.PublicKey{cert.Key, cert.SignatureKey} {
+				if revokedErr, ok := callback(hostname, remote, certKey).(*knownhosts.RevokedError); ok {
+					err = revokedErr
+					break
+				}
+			}
+		}
+		switch err := err.(type) {
+		case nil:
+			return nil
+		case *knownhosts.RevokedError:
+			return &hostKeyError{
+				hostname: hostname,
+				key:      key,
+				reason:   fmt.Sprintf("key is revoked (%v)", &err.Revoked),
+			}
+		case *knownhosts.KeyError:
+			if len(err.Want) == 0 && tofu && len(paths) > 0 {
+				return appendKnownHost(paths[0], hostname, key)
+			}
+			if len(err.Want) == 0 {
+				return &hostKeyError{
+					hostname: hostname,
+					key:      key,
+					reason:   fmt.Sprintf("unknown host (searched %s; use -host-key-tofu to accept new hosts, or pin the key with -host-key-fingerprint)", strings.Join(paths, ", ")),
+				}
+			}
+			var want []string
+			for _, known := range err.Want {
+				want = append(want, fmt.Sprintf("%s %s (%s:%d)", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+			}
+			return &hostKeyError{
+				hostname: hostname,
+				key:      key,
+				reason:   fmt.Sprintf("KEY MISMATCH, possible man-in-the-middle attack; known keys: %s", strings.Join(want, ", ")),
+			}
+		default:
+			// Certificates that are invalid, or not signed by a known authority.
+			return &hostKeyError{hostname: hostname, key: key, reason: err.Error()}
+		}
+	}
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("add known host: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("add known host: %v", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key)); err != nil {
+		return fmt.Errorf("add known host: %v", err)
+	}
+	log.Printf("warning: permanently added %s host key %s for %s to %s", key.Type(), ssh.FingerprintSHA256(key), knownhosts.Normalize(hostname), path)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestHostCert returns a host certificate for the key and principal, signed by the authority.
+func newTestHostCert(t *testing.T, key ssh.PublicKey, principal string, authority ssh.Signer) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestHostKeyCallbackKnownHosts(t *testing.T) {
+	hostKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+	authority := newTestSigner(t)
+	otherAuthority := newTestSigner(t)
+	authorizedKey := func(key ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	tests := []struct {
+		name       string
+		knownHosts string
+		hostname   string
+		key        ssh.PublicKey
+		// wantErr is a substring of the expected error, or "" if the key is accepted.
+		wantErr string
+	}{
+		{name: "known", knownHosts: knownhosts.Line([]string{"example.com"}, hostKey), hostname: "example.com:22", key: hostKey},
+		{name: "key mismatch", knownHosts: knownhosts.Line([]string{"example.com"}, hostKey), hostname: "example.com:22", key: otherKey, wantErr: "KEY MISMATCH"},
+		{name: "unknown host", knownHosts: knownhosts.Line([]string{"example.org"}, hostKey), hostname: "example.com:22", key: hostKey, wantErr: "unknown host"},
+		{name: "no known_hosts", hostname: "example.com:22", key: hostKey, wantErr: "unknown host"},
+		{
+			name:       "revoked",
+			knownHosts: "@revoked * " + authorizedKey(hostKey) + "\n" + knownhosts.Line([]string{"example.com"}, hostKey),
+			hostname:   "example.com:22",
+			key:        hostKey,
+			wantErr:    "revoked",
+		},
+		{name: "hashed hostname", knownHosts: knownhosts.Line([]string{knownhosts.HashHostname("example.com")}, hostKey), hostname: "example.com:22", key: hostKey},
+		{name: "hashed hostname mismatch", knownHosts: knownhosts.Line([]string{knownhosts.HashHostname("example.com")}, hostKey), hostname: "example.com:22", key: otherKey, wantErr: "KEY MISMATCH"},
+		{name: "port", knownHosts: knownhosts.Line([]string{"[example.com]:2222"}, hostKey), hostname: "example.com:2222", key: hostKey},
+		{name: "port mismatch", knownHosts: knownhosts.Line([]string{"[example.com]:2222"}, hostKey), hostname: "example.com:22", key: hostKey, wantErr: "unknown host"},
+		{name: "default port entry", knownHosts: knownhosts.Line([]string{"example.com"}, hostKey), hostname: "example.com:2222", key: hostKey, wantErr: "unknown host"},
+		{
+			name:       "cert authority",
+			knownHosts: "@cert-authority *.example.com " + authorizedKey(authority.PublicKey()),
+			hostname:   "host.example.com:22",
+			key:        newTestHostCert(t, hostKey, "host.example.com", authority),
+		},
+		{
+			name:       "cert authority, other authority",
+			knownHosts: "@cert-authority *.example.com " + authorizedKey(authority.PublicKey()),
+			hostname:   "host.example.com:22",
+			key:        newTestHostCert(t, hostKey, "host.example.com", otherAuthority),
+			wantErr:    "no authorities",
+		},
+		{
+			name:       "cert authority, other principal",
+			knownHosts: "@cert-authority *.example.com " + authorizedKey(authority.PublicKey()),
+			hostname:   "host.example.com:22",
+			key:        newTestHostCert(t, hostKey, "other.example.com", authority),
+			wantErr:    "principal",
+		},
+		{
+			name:       "cert authority, revoked authority",
+			knownHosts: "@cert-authority *.example.com " + authorizedKey(authority.PublicKey()) + "\n@revoked * " + authorizedKey(authority.PublicKey()),
+			hostname:   "host.example.com:22",
+			key:        newTestHostCert(t, hostKey, "host.example.com", authority),
+			wantErr:    "revoked",
+		},
+		{
+			name:       "cert authority, revoked key",
+			knownHosts: "@cert-authority *.example.com " + authorizedKey(authority.PublicKey()) + "\n@revoked * " + authorizedKey(hostKey),
+			hostname:   "host.example.com:22",
+			key:        newTestHostCert(t, hostKey, "host.example.com", authority),
+			wantErr:    "revoked",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "known_hosts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "known_hosts")
+			if tt.knownHosts != "" {
+				if err := ioutil.WriteFile(path, []byte(tt.knownHosts+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			callback := hostKeyCallbackKnownHosts([]string{path, filepath.Join(dir, "missing")}, false)
+			err = callback(tt.hostname, remote, tt.key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("callback() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("callback() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if _, ok := err.(*hostKeyError); !ok {
+				t.Errorf("callback() error = %v, want a *hostKeyError", err)
+			}
+		})
+	}
+}
+
+func TestHostKeyCallbackKnownHostsTOFU(t *testing.T) {
+	hostKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ssh", "known_hosts")
+	callback := hostKeyCallbackKnownHosts([]string{path, filepath.Join(dir, "global")}, true)
+
+	if err := callback("example.com:2222", remote, hostKey); err != nil {
+		t.Fatalf("callback() for an unknown host: error = %v", err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := knownhosts.Line([]string{"example.com:2222"}, hostKey) + "\n"; string(buf) != want {
+		t.Errorf("known_hosts = %q, want %q", buf, want)
+	}
+	if !strings.HasPrefix(string(buf), "[example.com]:2222 ") {
+		t.Errorf("known_hosts = %q, want an entry for [example.com]:2222", buf)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("known_hosts mode = %v, %v, want 0600", info.Mode(), err)
+	}
+	if err := callback("example.com:2222", remote, hostKey); err != nil {
+		t.Errorf("callback() for the added host: error = %v", err)
+	}
+	if err := callback("example.com:2222", remote, otherKey); err == nil || !strings.Contains(err.Error(), "KEY MISMATCH") {
+		t.Errorf("callback() for the added host with another key: error = %v, want a mismatch", err)
+	}
+	if buf2, _ := ioutil.ReadFile(path); string(buf2) != string(buf) {
+		t.Errorf("known_hosts = %q after the mismatch, want it unchanged", buf2)
+	}
+}
+
+func TestHostKeyCallbackFingerprints(t *testing.T) {
+	hostKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+	authority := newTestSigner(t)
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+	tests := []struct {
+		name         string
+		fingerprints []string
+		key          ssh.PublicKey
+		wantErr      bool
+	}{
+		{name: "match", fingerprints: []string{fingerprint}, key: hostKey},
+		{name: "one of several", fingerprints: []string{ssh.FingerprintSHA256(otherKey), fingerprint}, key: hostKey},
+		{name: "padded", fingerprints: []string{fingerprint + "="}, key: hostKey},
+		{name: "whitespace", fingerprints: []string{" " + fingerprint + "\n"}, key: hostKey},
+		{name: "mismatch", fingerprints: []string{fingerprint}, key: otherKey, wantErr: true},
+		{name: "without prefix", fingerprints: []string{strings.TrimPrefix(fingerprint, "SHA256:")}, key: hostKey, wantErr: true},
+		{name: "certificate of the key", fingerprints: []string{fingerprint}, key: newTestHostCert(t, hostKey, "example.com", authority)},
+		{name: "certificate of another key", fingerprints: []string{fingerprint}, key: newTestHostCert(t, otherKey, "example.com", authority), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hostKeyCallbackFingerprints(tt.fingerprints)("example.com:22", nil, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("callback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := err.(*hostKeyError); err != nil && !ok {
+				t.Errorf("callback() error = %v, want a *hostKeyError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// interactiveAuth provides password and keyboard-interactive authentication.
+//
+// Answers are remembered and given again when re-connecting, so that the user is only
+// prompted again if the server rejects them, or asks something new.
+type interactiveAuth struct {
+	// destination is user@host, as shown in prompts.
+	destination    string
+	password       *string
+	passwordAuth   bool
+	kbdInteractive bool
+	tries          int
+
+	mu           sync.Mutex
+	lastPassword *string
+	answers      map[string]string
+	promptErr    error
+}
+
+// Methods returns the auth methods for one connection attempt.
+func (a *interactiveAuth) Methods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if a.kbdInteractive {
+		asked := make(map[string]bool)
+		challenge := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return a.challenge(asked, instruction, questions, echos)
+		}
+		methods = append(methods, ssh.RetryableAuthMethod(ssh.KeyboardInteractive(challenge), a.tries))
+	}
+	if a.passwordAuth {
+		asked := false
+		password := func() (string, error) {
+			defer func() { asked = true }()
+			return a.passwordCallback(asked)
+		}
+		methods = append(methods, ssh.RetryableAuthMethod(ssh.PasswordCallback(password), a.tries))
+	}
+	return methods
+}
+
+// PromptError returns (and clears) the error of the last failed prompt, as *promptError.
+func (a *interactiveAuth) PromptError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.promptErr
+	a.promptErr = nil
+	if err == nil {
+		return nil
+	}
+	return &promptError{err: err}
+}
+
+func (a *interactiveAuth) passwordCallback(retry bool) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !retry && a.password != nil {
+		return *a.password, nil
+	}
+	if !retry && a.lastPassword != nil {
+		return *a.lastPassword, nil
+	}
+	password, err := prompt(fmt.Sprintf("%s's password: ", a.destination), false)
+	if err != nil {
+		a.promptErr = err
+		return "", err
+	}
+	a.lastPassword = &password
+	return password, nil
+}
+
+// challenge answers a keyboard-interactive challenge. Questions not yet asked during this
+// connection attempt are answered with the configured password (if they ask for a password),
+// or the previous answer; all others are prompted for.
+func (a *interactiveAuth) challenge(asked map[string]bool, instruction string, questions []string, echos []bool) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.answers == nil {
+		a.answers = make(map[string]string)
+	}
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		previous, ok := a.answers[question]
+		switch {
+		case asked[question]:
+		case a.password != nil && !echos[i] && strings.Contains(strings.ToLower(question), "password"):
+			answers[i] = *a.password
+			asked[question] = true
+			continue
+		case ok:
+			answers[i] = previous
+			asked[question] = true
+			continue
+		}
+		text := question
+		if instruction != "" {
+			text = instruction + "\n" + question
+			instruction = ""
+		}
+		if i == 0 && !strings.Contains(text, a.destination) {
+			text = fmt.Sprintf("(%s) %s", a.destination, text)
+		}
+		answer, err := prompt(text, echos[i])
+		if err != nil {
+			a.promptErr = err
+			return nil, err
+		}
+		answers[i] = answer
+		a.answers[question] = answer
+		asked[question] = true
+	}
+	return answers, nil
+}
+
+// InteractiveAuth returns the password and keyboard-interactive authentication for the host,
+// or nil if it is disabled, or there is neither a password nor a way to prompt for one.
+func (h sshHost) InteractiveAuth() (*interactiveAuth, error) {
+	if !h.PasswordAuthentication && !h.KbdInteractiveAuthentication {
+		return nil, nil
+	}
+	if h.Password == nil && (h.BatchMode || !canPrompt()) {
+		return nil, nil
+	}
+	tries := h.NumberOfPasswordPrompts
+	if tries < 1 {
+		return nil, errors.New("NumberOfPasswordPrompts must be at least 1")
+	}
+	return &interactiveAuth{
+		destination:    h.User + "@" + h.HostName,
+		password:       h.Password,
+		passwordAuth:   h.PasswordAuthentication,
+		kbdInteractive: h.KbdInteractiveAuthentication,
+		tries:          tries,
+	}, nil
+}
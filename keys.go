@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/shlex"
+	"github.com/sgreben/sshtunnel"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyPassphrasePrompts is the number of times a key passphrase is prompted for before giving up.
+const keyPassphrasePrompts = 3
+
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+// openSSHKey is the (outer) format of OpenSSH private keys.
+type openSSHKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+// errKeyEncrypted is returned for encrypted keys when there is neither a passphrase nor a way to prompt for one.
+var errKeyEncrypted = errors.New("key is encrypted, and its passphrase cannot be prompted for")
+
+// errKeyPassphraseIncorrect is returned when an encrypted key cannot be decrypted using the given passphrase.
+var errKeyPassphraseIncorrect = errors.New("incorrect passphrase")
+
+// identityKey returns the key given via -i or -ssh-key-env, or nil if neither is given.
+// If the key is encrypted, its passphrase is taken from -ssh-key-pass(-file, -env, -command),
+// or prompted for.
+func identityKey() (ssh.Signer, error) {
+	var key sshtunnel.KeySource
+	var name string
+	switch {
+	case flags.SSHKeyPath != "" && flags.SSHKeyEnv != "":
+		return nil, errors.New("-ssh-key-file and -ssh-key-env are mutually exclusive")
+	case flags.SSHKeyEnv != "":
+		value, ok := os.LookupEnv(flags.SSHKeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("$%s is not set", flags.SSHKeyEnv)
+		}
+		buf := []byte(value)
+		key.PEM = &buf
+		name = "$" + flags.SSHKeyEnv
+	case flags.SSHKeyPath != "":
+		key.Path = &flags.SSHKeyPath
+		name = flags.SSHKeyPath
+	default:
+		return nil, nil
+	}
+	passphrase, err := keyPassphrase()
+	if err != nil {
+		return nil, fmt.Errorf("read key passphrase: %v", err)
+	}
+	key.Passphrase = passphrase
+	signer, err := keySigner(key, name, true)
+	if err == errKeyEncrypted {
+		return nil, fmt.Errorf("%s: %v (use -ssh-key-pass-file, -ssh-key-pass-env or -ssh-key-pass-command)", name, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return signer, nil
+}
+
+// keyPassphrase returns the passphrase configured via -ssh-key-pass, -ssh-key-pass-file,
+// -ssh-key-pass-env or -ssh-key-pass-command, or nil.
+func keyPassphrase() (*[]byte, error) {
+	var sources []string
+	for _, name := range []string{"ssh-key-pass", "ssh-key-pass-file", "ssh-key-pass-env", "ssh-key-pass-command"} {
+		if flagsSet[name] {
+			sources = append(sources, "-"+name)
+		}
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("%s are mutually exclusive", strings.Join(sources, ", "))
+	}
+	var passphrase string
+	switch {
+	case flags.SSHKeyPassCommand != "":
+		args, err := shlex.Split(flags.SSHKeyPassCommand)
+		if err != nil {
+			return nil, fmt.Errorf("tokenize passphrase command %q: %v", flags.SSHKeyPassCommand, err)
+		}
+		if len(args) == 0 {
+			return nil, errors.New("empty passphrase command")
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("passphrase command: %v", err)
+		}
+		passphrase = strings.TrimRight(string(output), "\r\n")
+	case flags.SSHKeyPassFile != "" || flags.SSHKeyPassEnv != "":
+		secret, err := readSecret(flags.SSHKeyPassFile, flags.SSHKeyPassEnv)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = *secret
+	case flags.SSHKeyPass != "":
+		passphrase = flags.SSHKeyPass
+	default:
+		return nil, nil
+	}
+	buf := []byte(passphrase)
+	return &buf, nil
+}
+
+// keySigner returns the signer for the given key source, like KeySource.Key, but also
+// decrypts encrypted keys. If the key is encrypted and no passphrase is set,
+// the passphrase is prompted for (if interactive is set).
+func keySigner(key sshtunnel.KeySource, name string, interactive bool) (ssh.Signer, error) {
+	if key.Signer != nil {
+		return key.Signer, nil
+	}
+	var buf []byte
+	switch {
+	case key.PEM != nil:
+		buf = *key.PEM
+	case key.Path != nil:
+		var err error
+		buf, err = ioutil.ReadFile(*key.Path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return key.Key()
+	}
+	if !isEncryptedKey(buf) {
+		return ssh.ParsePrivateKey(buf)
+	}
+	if key.Passphrase != nil {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(buf, *key.Passphrase)
+		if err == x509.IncorrectPasswordError {
+			return nil, errKeyPassphraseIncorrect
+		}
+		return signer, err
+	}
+	if !interactive || !canPrompt() {
+		return nil, errKeyEncrypted
+	}
+	for i := 0; i < keyPassphrasePrompts; i++ {
+		passphrase, err := prompt(fmt.Sprintf("Enter passphrase for key '%s': ", name), false)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(buf, []byte(passphrase))
+		if err != x509.IncorrectPasswordError {
+			return signer, err
+		}
+	}
+	return nil, errKeyPassphraseIncorrect
+}
+
+// isEncryptedKey returns whether the given PEM-encoded private key is encrypted.
+func isEncryptedKey(buf []byte) bool {
+	_, err := ssh.ParseRawPrivateKey(buf)
+	_, encrypted := err.(*ssh.PassphraseMissingError)
+	return encrypted
+}
+
+// encryptedKeyPublicKey returns the public key of an encrypted OpenSSH-format key,
+// which is stored unencrypted, or nil.
+func encryptedKeyPublicKey(buf []byte) ssh.PublicKey {
+	_, err := ssh.ParseRawPrivateKey(buf)
+	if err, ok := err.(*ssh.PassphraseMissingError); ok {
+		return err.PublicKey
+	}
+	return nil
+}
+
+// marshalOpenSSHKey returns the given ed25519 key PEM-encoded in the (unencrypted) OpenSSH format.
+func marshalOpenSSHKey(key ed25519.PrivateKey, comment string) ([]byte, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	privateKey := struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check[:]),
+		Check2:  binary.BigEndian.Uint32(check[:]),
+		KeyType: ssh.KeyAlgoED25519,
+		Pub:     []byte(key.Public().(ed25519.PublicKey)),
+		Priv:    []byte(key),
+		Comment: comment,
+	}
+	// Without a cipher, the private key block is padded to a multiple of 8 bytes.
+	for i := 1; len(ssh.Marshal(privateKey))%8 != 0; i++ {
+		privateKey.Pad = append(privateKey.Pad, byte(i))
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte(openSSHKeyMagic), ssh.Marshal(openSSHKey{
+			CipherName:   "none",
+			KdfName:      "none",
+			NumKeys:      1,
+			PubKey:       publicKey.Marshal(),
+			PrivKeyBlock: ssh.Marshal(privateKey),
+		})...),
+	}), nil
+}
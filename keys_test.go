@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/sgreben/sshtunnel"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func readTestPublicKey(t *testing.T, path string) ssh.PublicKey {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+func TestKeySigner(t *testing.T) {
+	secret := []byte("secret")
+	wrong := []byte("wrong")
+	tests := []struct {
+		name       string
+		file       string
+		passphrase *[]byte
+		encrypted  bool
+		// embeddedPublicKey is set for encrypted keys that store their public key unencrypted.
+		embeddedPublicKey bool
+		err               error
+	}{
+		{name: "ed25519", file: "key_ed25519", passphrase: &secret, encrypted: true, embeddedPublicKey: true},
+		{name: "ecdsa", file: "key_ecdsa", passphrase: &secret, encrypted: true, embeddedPublicKey: true},
+		{name: "rsa pem", file: "key_rsa_pem", passphrase: &secret, encrypted: true},
+		{name: "ecdsa unencrypted", file: "key_ecdsa_plain"},
+		{name: "ecdsa unencrypted with passphrase", file: "key_ecdsa_plain", passphrase: &secret},
+		{name: "ed25519 wrong passphrase", file: "key_ed25519", passphrase: &wrong, encrypted: true, embeddedPublicKey: true, err: errKeyPassphraseIncorrect},
+		{name: "ecdsa wrong passphrase", file: "key_ecdsa", passphrase: &wrong, encrypted: true, embeddedPublicKey: true, err: errKeyPassphraseIncorrect},
+		{name: "rsa pem wrong passphrase", file: "key_rsa_pem", passphrase: &wrong, encrypted: true, err: errKeyPassphraseIncorrect},
+		{name: "ed25519 no passphrase", file: "key_ed25519", encrypted: true, embeddedPublicKey: true, err: errKeyEncrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			publicKey := readTestPublicKey(t, path+".pub")
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isEncryptedKey(buf); got != tt.encrypted {
+				t.Errorf("isEncryptedKey() = %v, want %v", got, tt.encrypted)
+			}
+			embedded := encryptedKeyPublicKey(buf)
+			switch {
+			case tt.embeddedPublicKey && (embedded == nil || !bytes.Equal(embedded.Marshal(), publicKey.Marshal())):
+				t.Errorf("encryptedKeyPublicKey() = %v, want the key of %s.pub", embedded, path)
+			case !tt.embeddedPublicKey && embedded != nil:
+				t.Errorf("encryptedKeyPublicKey() = %v, want nil", embedded)
+			}
+
+			signer, err := keySigner(sshtunnel.KeySource{PEM: &buf, Passphrase: tt.passphrase}, tt.file, false)
+			if err != tt.err {
+				t.Fatalf("keySigner() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), publicKey.Marshal()) {
+				t.Errorf("keySigner() public key = %v, want the key of %s.pub", signer.PublicKey(), path)
+			}
+		})
+	}
+}
+
+func TestMarshalOpenSSHKey(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := marshalOpenSSHKey(privateKey, "comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEncryptedKey(buf) {
+		t.Error("isEncryptedKey() = true, want false")
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey() error = %v", err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), sshPublicKey.Marshal()) {
+		t.Errorf("public key = %v, want %v", signer.PublicKey(), sshPublicKey)
+	}
+}
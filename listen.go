@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseListenAddr parses a -listen address: tcp://ip:port, unix:///path/to/socket,
+// or unix:// (a socket in a private temporary directory).
+func parseListenAddr(addr string) (net.Addr, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return &net.UnixAddr{Net: "unix", Name: strings.TrimPrefix(addr, "unix://")}, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return net.ResolveTCPAddr("tcp", strings.TrimPrefix(addr, "tcp://"))
+	default:
+		return nil, fmt.Errorf("invalid listen address %q (expected tcp://ip:port or unix:///path)", addr)
+	}
+}
+
+// dockerHost returns the DOCKER_HOST value for the given listener address.
+func dockerHost(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return "unix://" + addr.String()
+	}
+	return "tcp://" + addr.String()
+}
+
+// listenLocal opens the local listener for tunnelled connections.
+//
+// Unix sockets are created with mode 0600 (0660 if -listen-group is set), optionally owned by
+// -listen-owner / -listen-group. If no path is given, the socket is created in a private
+// temporary directory. Where supported, connections from peers other than the invoking user
+// (or the -listen-owner / -listen-group) are rejected.
+func listenLocal(laddr net.Addr) (net.Listener, error) {
+	unixAddr, ok := laddr.(*net.UnixAddr)
+	if !ok {
+		listener, err := net.Listen(laddr.Network(), laddr.String())
+		if err != nil {
+			return nil, fmt.Errorf("listen on %s://%s: %v", laddr.Network(), laddr.String(), err)
+		}
+		return listener, nil
+	}
+	path := unixAddr.Name
+	if path == "" {
+		dir, err := ioutil.TempDir("", appName)
+		if err != nil {
+			return nil, fmt.Errorf("create socket directory: %v", err)
+		}
+		state.cleanup = append(state.cleanup, func() { os.RemoveAll(dir) })
+		path = filepath.Join(dir, "docker.sock")
+	}
+	uid, gid := -1, -1
+	mode := os.FileMode(0600)
+	if flags.LocalListenOwner != "" {
+		var err error
+		if uid, err = lookupUserID(flags.LocalListenOwner); err != nil {
+			return nil, err
+		}
+	}
+	if flags.LocalListenGroup != "" {
+		var err error
+		if gid, err = lookupGroupID(flags.LocalListenGroup); err != nil {
+			return nil, err
+		}
+		mode = 0660
+	}
+	listener, err := listenUnix(path, mode)
+	if err != nil {
+		return nil, fmt.Errorf("listen on unix://%s: %v", path, err)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("chown %s: %v", path, err)
+		}
+	}
+	return &peerCheckListener{Listener: listener, uid: uid, gid: gid}, nil
+}
+
+func lookupUserID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroupID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// userInGroup returns whether the user is a member of the group, including as a supplementary group.
+func userInGroup(uid, gid int) bool {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return false
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, id := range groupIDs {
+		if id == strconv.Itoa(gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerCheckListener is a Unix socket listener that only accepts connections from
+// the invoking user, the given user (uid), or members of the given group (gid),
+// including members for which it is a supplementary group.
+type peerCheckListener struct {
+	net.Listener
+	uid, gid int
+}
+
+func (l *peerCheckListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, gid, ok, err := peerCredentials(conn)
+		switch {
+		case err != nil:
+			log.Printf("rejecting local connection: %v", err)
+		case !ok:
+			return conn, nil
+		case uid == os.Getuid(), uid == l.uid && l.uid != -1, l.gid != -1 && (gid == l.gid || userInGroup(uid, l.gid)):
+			return conn, nil
+		default:
+			log.Printf("rejecting local connection from uid %d (gid %d)", uid, gid)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testPeerEnvVar makes the test binary connect to the given socket as a peer (see TestPeerHelper).
+const testPeerEnvVar = "WITH_SSH_DOCKER_SOCKET_TEST_PEER"
+
+// TestPeerHelper is not a test: it is run as another user by TestPeerCheckListener.
+// It connects to the socket, writes "peer", and keeps the connection open until its stdin is closed.
+func TestPeerHelper(t *testing.T) {
+	path := os.Getenv(testPeerEnvVar)
+	if path == "" {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	io.WriteString(conn, "peer\n")
+	io.WriteString(os.Stdout, "connected\n")
+	io.Copy(ioutil.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+func TestPeerCheckListener(t *testing.T) {
+	const nobody = 65534
+	tests := []struct {
+		name string
+		// peer is the uid and gid of the peer, or -1 for the test process.
+		peer     int
+		uid, gid int
+		want     bool
+	}{
+		{name: "same user", peer: -1, uid: -1, gid: -1, want: true},
+		{name: "same user, other owner", peer: -1, uid: nobody, gid: nobody, want: true},
+		{name: "other user", peer: nobody, uid: -1, gid: -1},
+		{name: "owner", peer: nobody, uid: nobody, gid: -1, want: true},
+		{name: "other owner", peer: nobody, uid: nobody - 1, gid: -1},
+		{name: "group", peer: nobody, uid: -1, gid: nobody, want: true},
+		{name: "other group", peer: nobody, uid: -1, gid: nobody - 1},
+	}
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.peer != -1 && os.Getuid() != 0 {
+				t.Skip("connecting as another user requires root")
+			}
+			path := filepath.Join(dir, "docker.sock")
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			if err := os.Chmod(path, 0777); err != nil {
+				t.Fatal(err)
+			}
+			l := &peerCheckListener{Listener: listener, uid: tt.uid, gid: tt.gid}
+			if tt.peer != -1 {
+				stdin := startTestPeer(t, dir, path, tt.peer)
+				defer stdin.Close()
+			} else {
+				conn, err := net.Dial("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				io.WriteString(conn, "peer\n")
+			}
+			// A connection of the test process is always accepted, so it is accepted in place
+			// of the peer if the peer is rejected.
+			self, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer self.Close()
+			io.WriteString(self, "self\n")
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := line == "peer\n"; got != tt.want {
+				t.Errorf("peer accepted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// startTestPeer runs a copy of the test binary (in dir, so that it can be executed by the user)
+// as TestPeerHelper with the given uid and gid, and waits until it has connected to the socket.
+// The peer exits when the returned stdin is closed.
+func startTestPeer(t *testing.T, dir, path string, id int) io.WriteCloser {
+	executable := filepath.Join(dir, "peer.test")
+	if _, err := os.Stat(executable); os.IsNotExist(err) {
+		buf, err := ioutil.ReadFile(os.Args[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(executable, buf, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(executable, "-test.run=^TestPeerHelper$")
+	cmd.Env = append(os.Environ(), testPeerEnvVar+"="+path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(id), Gid: uint32(id)}}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); line != "connected\n" {
+		stdin.Close()
+		t.Fatalf("peer did not connect: %q, %v", line, err)
+	}
+	return stdin
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the changes of the (process-wide) umask by listenUnix.
+var umaskMu sync.Mutex
+
+// listenUnix listens on a Unix socket that is created with the given mode,
+// so that there is no window in which it is accessible with the default umask.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	oldMask := syscall.Umask(int(0777 &^ mode.Perm()))
+	defer syscall.Umask(oldMask)
+	return net.Listen("unix", path)
+}
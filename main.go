@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -8,12 +9,12 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"text/template"
 	"time"
 
-	"github.com/sgreben/sshtunnel"
 	"github.com/sgreben/sshtunnel/backoff"
 	sshtunnelExec "github.com/sgreben/sshtunnel/exec"
 
@@ -23,8 +24,44 @@ import (
 
 var flags struct {
 	SSHUser                    string
+	SSHConfigFile              string
+	SSHJumpHosts               stringsFlag
+	SSHProxy                   string
+	SSHProxyCommand            string
+	Transport                  string
+	DialStdioCommand           string
+	SSHControlPath             string
+	SSHPasswordFile            string
+	SSHPasswordEnv             string
+	RemoteSudo                 bool
+	RemoteSudoCommand          string
+	RemoteSudoPasswordFile     string
+	RemoteSudoPasswordEnv      string
 	SSHKeyPath                 string
 	SSHKeyPass                 string
+	SSHKeyPassFile             string
+	SSHKeyPassEnv              string
+	SSHKeyPassCommand          string
+	SSHKeyEnv                  string
+	SSHAgentKeys               stringsFlag
+	SSHCAKey                   string
+	SSHCAUseAgent              bool
+	SSHCertValidity            time.Duration
+	SSHCertPrincipals          stringsFlag
+	SSHCertExtensions          stringsFlag
+	ChildAgent                 bool
+	ChildAgentRestricted       bool
+	AutoForwardPorts           bool
+	SyncBinds                  bool
+	SyncBindsBack              bool
+	SyncBindsDir               string
+	SyncBindsRoots             stringsFlag
+	SyncBindsMaxSize           int64
+	PolicyFile                 string
+	AuthzPlugins               stringsFlag
+	AuditLog                   string
+	Setup                      bool
+	SetupKeyFile               string
 	SSHAddr                    string
 	SSHHost                    string
 	SSHPort                    string
@@ -36,26 +73,85 @@ var flags struct {
 	SSHAuthSocketAddr          string
 	LocalListenIP              string
 	LocalListenPort            int
+	LocalListenAddr            string
+	LocalListenOwner           string
+	LocalListenGroup           string
+	KillGracePeriod            time.Duration
+	Resilient                  bool
+	Daemon                     bool
+	DaemonKill                 bool
+	DaemonPIDFile              string
+	DaemonStateFile            string
+	DaemonLogFile              string
+	ExportFormat               string
+	ControlMaster              bool
+	ControlPath                string
+	ControlPersist             time.Duration
+	ReconnectTimeout           time.Duration
 	EnvVarName                 string
 	CommandName                string
 	CommandArgs                []string
 	Verbose                    bool
 	BackoffConfig              backoff.Config
 	Version                    bool
+	KnownHostsFiles            stringsFlag
+	HostKeyFingerprints        stringsFlag
+	HostKeyTOFU                bool
+	HostKeyInsecure            bool
 }
 
 var state struct {
 	sshKey     ssh.Signer
 	sshAgent   agent.Agent
-	listenAddr *net.TCPAddr
+	listenAddr net.Addr
+
+	// ephemeralKey is the in-memory key certified by the CA given via -ssh-ca-key.
+	ephemeralKey *ephemeralKey
+	// childAgentSock is the socket of the ssh-agent served to the command (-child-agent).
+	childAgentSock string
+	// apiHooks inspect the Docker API requests passing through the tunnel (-audit-log). If there are
+	// no hooks at all, connections are forwarded without being read.
+	apiHooks []apiHook
+	// authHooks authorize the Docker API requests passing through the tunnel (-policy-file, -authz-plugin).
+	// They run after the apiHooks, and before the rewriteHooks, so that they check the requests as
+	// given by the client, before the rewriteHooks act on them.
+	authHooks []apiHook
+	// rewriteHooks rewrite the Docker API requests passing through the tunnel, and may have side
+	// effects (-sync-binds).
+	rewriteHooks []apiHook
 
 	listener net.Listener
+	// dockerHost is the value of the environment variable set for the command.
+	dockerHost string
+	// controlListener is the control socket listener of a control master.
+	controlListener net.Listener
+	// cleanup functions are run before exiting, in reverse order.
+	cleanup []func()
+	// tunnelErr receives tunnel failures that occur after setup.
+	tunnelErr chan error
 }
 
 const appName = "with-ssh-docker-socket"
 
 var version = "SNAPSHOT"
-var nonzeroExit bool
+
+// flagsSet holds the names of the flags given on the command line.
+var flagsSet = make(map[string]bool)
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
 func init() {
 	flags.SSHAuthSocketAddr = os.Getenv("SSH_AUTH_SOCK")
@@ -64,6 +160,14 @@ func init() {
 	flags.LocalListenIP = "127.0.0.1"
 	flags.EnvVarName = "DOCKER_HOST"
 	flags.LocalListenPort = 0
+	flags.Transport = transportStreamLocal
+	flags.DialStdioCommand = "docker -H unix://{{.RemoteSocketPath}} system dial-stdio"
+	flags.RemoteSudoCommand = "sudo -S -p {{.SudoPrompt}} sh -c 'echo {{.ReadyMarker}} && exec socat STDIO UNIX-CONNECT:\"$1\"' sh {{quote .RemoteSocketPath}}"
+	flags.KillGracePeriod = 10 * time.Second
+	flags.SyncBindsMaxSize = 1 << 30
+	flags.ReconnectTimeout = time.Minute
+	flags.SSHCertValidity = 5 * time.Minute
+	flags.ExportFormat = exportFormatSh
 	flags.BackoffConfig.Min = 250 * time.Millisecond
 	flags.BackoffConfig.Max = 15 * time.Second
 	flags.BackoffConfig.MaxAttempts = 10
@@ -72,15 +176,54 @@ func init() {
 	log.SetPrefix(fmt.Sprintf("[%s] ", appName))
 	log.SetFlags(0)
 	flag.StringVar(&flags.SSHAuthSocketAddr, "ssh-auth-sock", flags.SSHAuthSocketAddr, "ssh-agent socket address ($SSH_AUTH_SOCK)")
+	flag.Var(&flags.SSHAgentKeys, "ssh-agent-key", "offer only this ssh-agent key: `SHA256:...` fingerprint, public key file, or comment (repeatable) (like IdentitiesOnly)")
 	flag.StringVar(&flags.SSHKeyPath, "ssh-key-file", flags.SSHKeyPath, "path of an ssh key file")
 	flag.StringVar(&flags.SSHKeyPath, "i", flags.SSHKeyPath, "(alias for -ssh-key-file)")
-	flag.StringVar(&flags.SSHKeyPass, "ssh-key-pass", flags.SSHKeyPass, "passphrase for the ssh key file given via `-i`")
+	flag.StringVar(&flags.SSHPasswordFile, "ssh-password-file", flags.SSHPasswordFile, "read the ssh password from this file (otherwise, it is prompted for if needed)")
+	flag.StringVar(&flags.SSHPasswordEnv, "ssh-password-env", flags.SSHPasswordEnv, "read the ssh password from this environment variable (otherwise, it is prompted for if needed)")
+	flag.StringVar(&flags.SSHKeyEnv, "ssh-key-env", flags.SSHKeyEnv, "read the (PEM-encoded) ssh key from this environment variable instead of a file")
+	flag.StringVar(&flags.SSHKeyPass, "ssh-key-pass", flags.SSHKeyPass, "passphrase for the ssh key given via `-i` (visible to other users; prefer -ssh-key-pass-file, -ssh-key-pass-env or -ssh-key-pass-command) (otherwise, it is prompted for if needed)")
+	flag.StringVar(&flags.SSHKeyPassFile, "ssh-key-pass-file", flags.SSHKeyPassFile, "read the passphrase for the ssh key given via -i from this file")
+	flag.StringVar(&flags.SSHKeyPassEnv, "ssh-key-pass-env", flags.SSHKeyPassEnv, "read the passphrase for the ssh key given via -i from this environment variable")
+	flag.StringVar(&flags.SSHKeyPassCommand, "ssh-key-pass-command", flags.SSHKeyPassCommand, "read the passphrase for the ssh key given via -i from the output of this command (e.g. \"pass show ssh/deploy\")")
+	flag.StringVar(&flags.SSHCAKey, "ssh-ca-key", flags.SSHCAKey, "authenticate using an ephemeral in-memory key, certified by this CA key file for each connection (with -ssh-ca-agent: the CA's public key file)")
+	flag.BoolVar(&flags.SSHCAUseAgent, "ssh-ca-agent", flags.SSHCAUseAgent, "the private key of the CA given via -ssh-ca-key is held by ssh-agent")
+	flag.DurationVar(&flags.SSHCertValidity, "ssh-cert-validity", flags.SSHCertValidity, "validity of the ephemeral certificates for -ssh-ca-key")
+	flag.Var(&flags.SSHCertPrincipals, "ssh-cert-principal", "principal of the ephemeral certificates for -ssh-ca-key (repeatable) (default: the ssh user names)")
+	flag.Var(&flags.SSHCertExtensions, "ssh-cert-extension", "`name[=value]` extension of the ephemeral certificates for -ssh-ca-key (repeatable) (default: "+strings.Join(defaultEphemeralExtensions, ", ")+")")
+	flag.BoolVar(&flags.ChildAgent, "child-agent", flags.ChildAgent, "serve the keys used for the ssh connection to the command via an ssh-agent socket in a private temporary directory ($SSH_AUTH_SOCK) (native ssh client only)")
+	flag.BoolVar(&flags.ChildAgentRestricted, "child-agent-restricted", flags.ChildAgentRestricted, "with -child-agent, only allow listing keys and signing (no adding, removing or locking keys)")
+	flag.StringVar(&flags.SetupKeyFile, "setup-key-file", flags.SetupKeyFile, "with the setup command, the key file to generate and install (used if it exists) (default: ~/.ssh/"+appName+"_<host>_ed25519)")
+	flag.BoolVar(&flags.AutoForwardPorts, "auto-forward-ports", flags.AutoForwardPorts, "forward the host ports published by remote containers to the same local ports (on -listen-ip) over the ssh connection, while the containers run (native ssh client only)")
+	flag.BoolVar(&flags.SyncBinds, "sync-binds", flags.SyncBinds, "copy the local sources of bind mounts of created containers to a staging directory on the remote host, and mount that instead (native ssh client only)")
+	flag.BoolVar(&flags.SyncBindsBack, "sync-binds-back", flags.SyncBindsBack, "copy the staged directories of -sync-binds back to the local sources whenever a container exits (implies -sync-binds)")
+	flag.Var(&flags.SyncBindsRoots, "sync-binds-root", "with -sync-binds, a local `directory` whose contents may be copied (repeatable; default: the working directory and the home directory)")
+	flag.Int64Var(&flags.SyncBindsMaxSize, "sync-binds-max-size", flags.SyncBindsMaxSize, "with -sync-binds, the maximum total size in bytes of the files of a bind mount source")
+	flag.StringVar(&flags.SyncBindsDir, "sync-binds-dir", flags.SyncBindsDir, "with -sync-binds, the remote directory in which to create the staging directory (default: $TMPDIR or /tmp on the remote host)")
+	flag.StringVar(&flags.PolicyFile, "policy-file", flags.PolicyFile, "check the Docker API requests passing through the tunnel against the rules in this JSON `file`, and deny those not allowed (native ssh client only)")
+	flag.Var(&flags.AuthzPlugins, "authz-plugin", "authorize the Docker API requests passing through the tunnel using the Docker authorization plugin at this `address` (unix socket path or http:// URL) (repeatable) (native ssh client only)")
+	flag.StringVar(&flags.AuditLog, "audit-log", flags.AuditLog, "append a JSON line for each Docker API request passing through the tunnel to this `file` (native ssh client only)")
 	flag.StringVar(&flags.RemoteSocketAddr, "remote-socket-path", flags.RemoteSocketAddr, "remote socket path")
 	flag.StringVar(&flags.RemoteSocketAddr, "s", flags.RemoteSocketAddr, "(alias for -remote-socket-path)")
 	flag.StringVar(&flags.LocalListenIP, "listen-ip", flags.LocalListenIP, "local IP to listen on")
 	flag.IntVar(&flags.LocalListenPort, "listen-port", flags.LocalListenPort, "local TCP port to listen on (set to 0 to assign a random free port)")
 	flag.IntVar(&flags.LocalListenPort, "p", flags.LocalListenPort, "(alias for -listen-port)")
-	flag.StringVar(&flags.SSHAddr, "ssh-server-addr", flags.SSHAddr, "(remote) ssh server address [user@]host[:port]")
+	flag.StringVar(&flags.LocalListenAddr, "listen", flags.LocalListenAddr, "local address to listen on: `tcp://ip:port`, unix:///path/to/socket, or unix:// for a socket in a private temporary directory (overrides -listen-ip and -listen-port)")
+	flag.StringVar(&flags.LocalListenOwner, "listen-owner", flags.LocalListenOwner, "owner (user name or uid) of the unix socket given via -listen")
+	flag.StringVar(&flags.LocalListenGroup, "listen-group", flags.LocalListenGroup, "group (name or gid) of the unix socket given via -listen; makes the socket group-accessible")
+	flag.StringVar(&flags.SSHAddr, "ssh-server-addr", flags.SSHAddr, "(remote) ssh server address [user@]host[:port] (host may be a Host alias from the ssh config)")
+	flag.Var(&flags.SSHJumpHosts, "ssh-jump-host", "connect via this jump host `[user@]host[:port]` (repeatable, or comma-separated; overrides ProxyJump from the ssh config)")
+	flag.Var(&flags.SSHJumpHosts, "J", "(alias for -ssh-jump-host)")
+	flag.StringVar(&flags.SSHProxy, "ssh-proxy", flags.SSHProxy, "connect to the (first) ssh server through this proxy `URL` (socks5://[user:pass@]host[:port] or http(s)://[user:pass@]host[:port])")
+	flag.StringVar(&flags.SSHProxyCommand, "ssh-proxy-command", flags.SSHProxyCommand, "connect to the (first) ssh server using the stdin/stdout of this command (like ProxyCommand; %h, %p and %r are expanded)")
+	flag.StringVar(&flags.Transport, "transport", flags.Transport, fmt.Sprintf("how to reach the remote socket: %q (forward the socket), %q (run -dial-stdio-command on the remote host), %q (run -remote-sudo-command on the remote host, same as -remote-sudo) or %q (forward the socket through a running OpenSSH master connection, see -ssh-control-path) (native ssh client only)", transportStreamLocal, transportDialStdio, transportSudo, transportOpenSSHMux))
+	flag.StringVar(&flags.SSHControlPath, "ssh-control-path", flags.SSHControlPath, "control socket of the OpenSSH master connection for -transport=openssh-mux (default: ControlPath from the ssh config)")
+	flag.StringVar(&flags.DialStdioCommand, "dial-stdio-command", flags.DialStdioCommand, "remote command template for -transport=dial-stdio (e.g. \"podman system dial-stdio\")")
+	flag.BoolVar(&flags.RemoteSudo, "remote-sudo", flags.RemoteSudo, "access the remote socket as root using sudo (alias for -transport=sudo)")
+	flag.StringVar(&flags.RemoteSudoCommand, "remote-sudo-command", flags.RemoteSudoCommand, "remote command template for -transport=sudo (must print {{.ReadyMarker}} once privileges are obtained, and prompt for passwords using {{.SudoPrompt}})")
+	flag.StringVar(&flags.RemoteSudoPasswordFile, "remote-sudo-password-file", flags.RemoteSudoPasswordFile, "read the remote sudo password from this file")
+	flag.StringVar(&flags.RemoteSudoPasswordEnv, "remote-sudo-password-env", flags.RemoteSudoPasswordEnv, "read the remote sudo password from this environment variable")
+	flag.StringVar(&flags.SSHConfigFile, "F", flags.SSHConfigFile, "ssh config file (default: ~/.ssh/config, /etc/ssh/ssh_config)")
 	flag.StringVar(&flags.SSHAddr, "a", flags.SSHAddr, "(alias for -ssh-server-addr)")
 	flag.StringVar(&flags.EnvVarName, "env-var-name", flags.EnvVarName, "environment variable to set")
 	flag.StringVar(&flags.EnvVarName, "e", flags.EnvVarName, "(alias for -env-var-name)")
@@ -94,28 +237,73 @@ func init() {
 	flag.DurationVar(&flags.BackoffConfig.Max, "ssh-max-delay", flags.BackoffConfig.Max, "maximum re-connection attempt delay")
 	flag.DurationVar(&flags.BackoffConfig.Min, "ssh-min-delay", flags.BackoffConfig.Min, "minimum re-connection attempt delay")
 	flag.IntVar(&flags.BackoffConfig.MaxAttempts, "ssh-max-attempts", flags.BackoffConfig.MaxAttempts, "maximum number of ssh re-connection attempts")
+	flag.BoolVar(&flags.Resilient, "resilient", flags.Resilient, "keep running when the ssh connection drops: re-connect in the background without limit on the number of attempts (-ssh-max-attempts only applies to the first connection)")
+	flag.DurationVar(&flags.ReconnectTimeout, "reconnect-timeout", flags.ReconnectTimeout, "with -resilient, how long new connections wait for the ssh connection to be re-established")
+	flag.Var(&flags.KnownHostsFiles, "known-hosts-file", "known_hosts file to verify host keys against (repeatable) (default: ~/.ssh/known_hosts, /etc/ssh/ssh_known_hosts)")
+	flag.Var(&flags.HostKeyFingerprints, "host-key-fingerprint", "accept only the host key with this fingerprint `SHA256:...` (repeatable) (known_hosts files are not consulted)")
+	flag.BoolVar(&flags.HostKeyTOFU, "host-key-tofu", flags.HostKeyTOFU, "trust on first use: accept host keys of unknown hosts and add them to the (first) known_hosts file")
+	flag.BoolVar(&flags.HostKeyInsecure, "insecure-ignore-host-key", flags.HostKeyInsecure, "do not verify host keys (insecure)")
+	flag.BoolVar(&flags.Daemon, "daemon", flags.Daemon, "run in the background without a command, and print the environment variables to set (see -export-format)")
+	flag.BoolVar(&flags.DaemonKill, "kill", flags.DaemonKill, "stop the background instance for -a (or -pid-file, or $"+daemonPIDEnvVar+"), and print the environment variables to unset")
+	flag.StringVar(&flags.ExportFormat, "export-format", flags.ExportFormat, "format of the environment variables printed by -daemon and -kill: sh, fish, powershell or json")
+	flag.StringVar(&flags.DaemonPIDFile, "pid-file", flags.DaemonPIDFile, "pid file of the background instance (default: derived from -a, in $XDG_RUNTIME_DIR or the temporary directory)")
+	flag.StringVar(&flags.DaemonStateFile, "state-file", flags.DaemonStateFile, "JSON state file of the background instance (default: next to the pid file)")
+	flag.StringVar(&flags.DaemonLogFile, "log-file", flags.DaemonLogFile, "log file of the background instance (default: discard log messages)")
+	flag.BoolVar(&flags.ControlMaster, "control-master", flags.ControlMaster, "share one tunnel between concurrent invocations for the same user@host:port and remote socket, using a control socket")
+	flag.StringVar(&flags.ControlPath, "control-path", flags.ControlPath, "path of the control socket for -control-master (default: derived from the resolved hosts, the transport, the remote socket, the listen address and the -policy-file, -authz-plugin and -audit-log options, in $XDG_RUNTIME_DIR or the temporary directory)")
+	flag.DurationVar(&flags.ControlPersist, "control-persist", flags.ControlPersist, "with -control-master, how long the shared tunnel stays up after the last invocation using it has exited")
+	flag.DurationVar(&flags.KillGracePeriod, "kill-grace-period", flags.KillGracePeriod, "time to wait for the command to exit after forwarding a signal to it, before killing it")
+}
 
-	flag.Parse()
+// start parses the command line and sets up the tunnel, or handles the commands that exit
+// right away (-version, -kill, setup).
+func start() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == setupCommand {
+		flags.Setup = true
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	state.tunnelErr = make(chan error, 1)
+	flag.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+	startPromptRelay()
 
 	if flags.Version {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
+	if flags.DaemonKill {
+		killDaemon()
+		os.Exit(0)
+	}
+
 	if flags.SSHAddr == "" {
 		flag.Usage()
 		log.Fatal("error: no ssh server address specified (-ssh-server-addr / -a)")
 	}
 
+	if len(flags.KnownHostsFiles) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			flags.KnownHostsFiles = append(flags.KnownHostsFiles, filepath.Join(home, ".ssh", "known_hosts"))
+		}
+		flags.KnownHostsFiles = append(flags.KnownHostsFiles, "/etc/ssh/ssh_known_hosts")
+	}
+
 	flags.SSHHost = flags.SSHAddr
 	flags.SSHPort = "22"
-	if i := strings.IndexRune(flags.SSHAddr, '@'); i >= 0 {
+	if i := strings.LastIndex(flags.SSHAddr, "@"); i >= 0 {
 		flags.SSHUser, flags.SSHHost = flags.SSHAddr[:i], flags.SSHAddr[i+1:]
 	}
 	if host, port, err := net.SplitHostPort(flags.SSHHost); err == nil {
 		flags.SSHHost, flags.SSHPort = host, port
 	}
 
+	if flags.Setup {
+		runSetup()
+		os.Exit(0)
+	}
+
 	if flag.NArg() > 0 {
 		flags.CommandName = flag.Arg(0)
 	}
@@ -127,15 +315,70 @@ func init() {
 		IP:   net.ParseIP(flags.LocalListenIP),
 		Port: flags.LocalListenPort,
 	}
+	if flags.LocalListenAddr != "" {
+		listenAddr, err := parseListenAddr(flags.LocalListenAddr)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		state.listenAddr = listenAddr
+	}
+
+	if flags.Daemon && os.Getenv(controlMasterEnvVar) == "" {
+		if os.Getenv(daemonChildEnvVar) == "" {
+			startDaemon()
+		}
+		os.Unsetenv(daemonChildEnvVar)
+	}
 
-	if flags.CommandName == "" {
+	if flags.CommandName == "" && !flags.Daemon {
 		flags.CommandName = os.Getenv("SHELL")
 	}
 
-	if flags.CommandName == "" {
+	if flags.CommandName == "" && !flags.Daemon {
 		log.Fatal("no command specified, and no $SHELL defined")
 	}
 
+	if flags.RemoteSudo {
+		flags.Transport = transportSudo
+	}
+
+	if flags.SyncBindsBack {
+		flags.SyncBinds = true
+	}
+
+	if flags.ChildAgent && (flags.PolicyFile != "" || len(flags.AuthzPlugins) > 0) {
+		log.Fatal("error: -child-agent cannot be used with -policy-file or -authz-plugin, since the command could use the agent to reach the remote Docker socket directly")
+	}
+
+	if flags.PolicyFile != "" {
+		policy, err := readPolicyFile(flags.PolicyFile)
+		if err != nil {
+			log.Fatalf("error: read policy: %v", err)
+		}
+		state.authHooks = append(state.authHooks, policy)
+	}
+
+	if flags.ControlMaster {
+		if os.Getenv(controlMasterEnvVar) == "" {
+			useControlMaster()
+			return
+		}
+		os.Unsetenv(controlMasterEnvVar)
+		path, err := controlPath()
+		if err != nil {
+			fatalTunnelf("tunnel setup failed: %v", err)
+		}
+		listener, err := listenControl(path)
+		if err == errControlMasterRunning {
+			os.Exit(0)
+		}
+		if err != nil {
+			fatalTunnelf("tunnel setup failed: %v", err)
+		}
+		state.controlListener = listener
+		state.cleanup = append(state.cleanup, func() { listener.Close() })
+	}
+
 	if flags.SSHExternalClientOpenSSH {
 		flags.SSHExternalClient = sshtunnelExec.CommandTemplateOpenSSHText
 	}
@@ -143,6 +386,24 @@ func init() {
 		flags.SSHExternalClient = sshtunnelExec.CommandTemplatePuTTYText
 	}
 	if flags.SSHExternalClient != "" {
+		if flags.ChildAgent {
+			log.Fatal("error: -child-agent requires the native ssh client")
+		}
+		if flags.AutoForwardPorts {
+			log.Fatal("error: -auto-forward-ports requires the native ssh client")
+		}
+		if flags.SyncBinds {
+			log.Fatal("error: -sync-binds requires the native ssh client")
+		}
+		if flags.PolicyFile != "" {
+			log.Fatal("error: -policy-file requires the native ssh client")
+		}
+		if len(flags.AuthzPlugins) > 0 {
+			log.Fatal("error: -authz-plugin requires the native ssh client")
+		}
+		if flags.AuditLog != "" {
+			log.Fatal("error: -audit-log requires the native ssh client")
+		}
 		useSSHClientExternal()
 		return
 	}
@@ -150,57 +411,191 @@ func init() {
 }
 
 func useSSHClientNative() {
-	var authConfig sshtunnel.ConfigAuth
-	if flags.SSHKeyPath != "" {
-		key := sshtunnel.KeySource{
-			Path: &flags.SSHKeyPath,
+	hosts := nativeHosts()
+	ctx := context.Background()
+	if len(flags.AuthzPlugins) > 0 {
+		authz, err := newAuthz(flags.AuthzPlugins, hosts[len(hosts)-1].User)
+		if err != nil {
+			log.Fatalf("error: %v", err)
 		}
-		if flags.SSHKeyPass != "" {
-			passphrase := []byte(flags.SSHKeyPass)
-			key.Passphrase = &passphrase
+		state.authHooks = append(state.authHooks, authz)
+	}
+	if flags.AuditLog != "" {
+		audit, err := openAuditLog(flags.AuditLog, hosts[len(hosts)-1])
+		if err != nil {
+			log.Fatalf("error: %v", err)
 		}
-		authConfig.Keys = append(authConfig.Keys, key)
+		// The audit log is the first hook, so that it records the requests as they are received.
+		state.apiHooks = append(state.apiHooks, audit)
+		state.cleanup = append(state.cleanup, func() { audit.Close() })
 	}
-
-	if flags.SSHAuthSocketAddr != "" {
-		authConfig.SSHAgent = &sshtunnel.ConfigSSHAgent{
-			Addr: &net.UnixAddr{
-				Net:  "unix",
-				Name: flags.SSHAuthSocketAddr,
-			},
+	if flags.Transport == transportOpenSSHMux {
+		if flags.ChildAgent {
+			log.Fatalf("error: -child-agent is not supported with -transport=%s", transportOpenSSHMux)
+		}
+		if flags.AutoForwardPorts {
+			log.Fatalf("error: -auto-forward-ports is not supported with -transport=%s", transportOpenSSHMux)
+		}
+		if flags.SyncBinds {
+			log.Fatalf("error: -sync-binds is not supported with -transport=%s", transportOpenSSHMux)
+		}
+		target := hosts[len(hosts)-1]
+		controlPath := target.ControlPath
+		if flags.SSHControlPath != "" {
+			controlPath = expandTilde(target.expandTokens(flags.SSHControlPath))
 		}
+		if controlPath == "" {
+			fatalTunnelf("tunnel setup failed: no ControlPath configured for %s (use -ssh-control-path)", target.Alias)
+		}
+		dial, err := openSSHMuxDialer(controlPath)
+		if err != nil {
+			fatalTunnelf("tunnel connection failed: %v", err)
+		}
+		serveLocal(ctx, dial)
+		return
 	}
-	auth, err := authConfig.Methods()
+	hops := nativeHops(hosts)
+	session := newSession(hops, flags.BackoffConfig, flags.Resilient)
+	dial, err := transportDialer(session)
 	if err != nil {
-		log.Fatalf("tunnel auth setup failed: %v", err)
+		fatalTunnelf("tunnel setup failed: %v", err)
 	}
-	clientConfig := &ssh.ClientConfig{
-		User:            flags.SSHUser,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	if flags.Resilient {
+		dial = dialWithTimeout(dial, flags.ReconnectTimeout)
 	}
-	tunnelConfig := &sshtunnel.Config{
-		SSHAddr:   flags.SSHHost + ":" + flags.SSHPort,
-		SSHClient: clientConfig,
+	if _, err := session.Client(ctx); err != nil {
+		fatalTunnelf("tunnel connection failed: %v", err)
 	}
-	listener, errCh, err := sshtunnel.Listen(
-		&net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
-		"unix",
-		flags.RemoteSocketAddr,
-		tunnelConfig,
-		flags.BackoffConfig,
-	)
-	if err != nil {
-		log.Fatalf("tunnel connection failed: %v", err)
+	if flags.SyncBinds {
+		state.rewriteHooks = append(state.rewriteHooks, newBindSync(session, dial, flags.SyncBindsDir, flags.SyncBindsBack, flags.SyncBindsRoots, flags.SyncBindsMaxSize))
 	}
-	go func() {
-		err, ok := <-errCh
-		if !ok {
-			return
+	serveLocal(ctx, dial)
+	if flags.ChildAgent {
+		path, err := serveChildAgent(newChildAgent(hops[len(hops)-1].Keys, flags.ChildAgentRestricted))
+		if err != nil {
+			log.Fatalf("error: child agent: %v", err)
 		}
-		log.Fatalf("tunnel connection failed: %v", err)
+		state.childAgentSock = path
+	}
+	if flags.AutoForwardPorts {
+		ctx, cancel := context.WithCancel(ctx)
+		state.cleanup = append(state.cleanup, cancel)
+		go newPortForwarder(dial, session.Dial).Run(ctx)
+	}
+	go func() {
+		tunnelFailed(<-session.Err())
 	}()
+}
+
+// nativeHosts resolves the hosts of the connection to -a (the jump hosts followed by the target)
+// using the ssh config.
+func nativeHosts() []sshHost {
+	hosts := configuredHosts()
+	hosts[len(hosts)-1].HostKeyFingerprints = flags.HostKeyFingerprints
+	password, err := readSecret(flags.SSHPasswordFile, flags.SSHPasswordEnv)
+	if err != nil {
+		log.Fatalf("error: read ssh password: %v", err)
+	}
+	hosts[len(hosts)-1].Password = password
+	return hosts
+}
+
+// configuredHosts resolves the hosts of the connection to -a (the jump hosts followed by the target)
+// using the ssh config, without their secrets.
+func configuredHosts() []sshHost {
+	sshConfigFiles := defaultSSHConfigFiles()
+	if flags.SSHConfigFile != "" {
+		sshConfigFiles = []string{flags.SSHConfigFile}
+	}
+	sshConfig, err := readSSHConfigFiles(sshConfigFiles...)
+	if err != nil {
+		log.Fatalf("read ssh config: %v", err)
+	}
+	var jumpHosts []string
+	for _, jumpHost := range flags.SSHJumpHosts {
+		jumpHosts = append(jumpHosts, strings.Split(jumpHost, ",")...)
+	}
+	hosts, err := sshHostChain(sshConfig, parseSSHHostSpec(flags.SSHAddr), jumpHosts)
+	if err != nil {
+		fatalTunnelf("tunnel setup failed: %v", err)
+	}
+	return hosts
+}
+
+// nativeHops loads the keys and sets up authentication for the given hosts.
+func nativeHops(hosts []sshHost) []sshHop {
+	var err error
+	state.sshKey, err = identityKey()
+	if err != nil {
+		log.Fatalf("error: load ssh key: %v", err)
+	}
+	if flags.SSHCAKey != "" {
+		principals := []string(flags.SSHCertPrincipals)
+		if len(principals) == 0 {
+			seen := make(map[string]bool)
+			for _, host := range hosts {
+				if !seen[host.User] {
+					principals = append(principals, host.User)
+					seen[host.User] = true
+				}
+			}
+		}
+		extensions := []string(flags.SSHCertExtensions)
+		if len(extensions) == 0 {
+			extensions = defaultEphemeralExtensions
+		}
+		state.ephemeralKey, err = newEphemeralKey(flags.SSHCAKey, flags.SSHCAUseAgent, flags.SSHCertValidity, principals, extensions)
+		if err != nil {
+			log.Fatalf("error: ephemeral key: %v", err)
+		}
+	}
+	var hops []sshHop
+	for _, host := range hosts {
+		if flags.Verbose {
+			log.Printf("ssh host %q: %s@%s", host.Alias, host.User, host.Addr())
+		}
+		hop, err := host.Hop()
+		if err != nil {
+			fatalTunnelf("tunnel auth setup failed: %v", err)
+		}
+		if hop.Dial != nil && len(hops) > 0 {
+			log.Fatalf("error: %s: ProxyCommand is only supported for the first host of a jump host chain", host.Alias)
+		}
+		hops = append(hops, hop)
+	}
+	switch {
+	case flags.SSHProxy != "" && flags.SSHProxyCommand != "":
+		log.Fatal("error: -ssh-proxy and -ssh-proxy-command are mutually exclusive")
+	case flags.SSHProxy != "":
+		dial, err := proxyDialer(flags.SSHProxy)
+		if err != nil {
+			fatalTunnelf("tunnel setup failed: %v", err)
+		}
+		hops[0].Dial = dial
+	case flags.SSHProxyCommand != "":
+		hops[0].Dial = proxyCommandDialer(hosts[0].expandTokens(flags.SSHProxyCommand))
+	}
+	return hops
+}
+
+// serveLocal serves connections tunnelled using dial on the local listen address.
+func serveLocal(ctx context.Context, dial func(context.Context) (net.Conn, error)) {
+	listener, err := listenLocal(state.listenAddr)
+	if err != nil {
+		fatalTunnelf("tunnel setup failed: %v", err)
+	}
+	var hooks []apiHook
+	hooks = append(hooks, state.apiHooks...)
+	hooks = append(hooks, state.authHooks...)
+	hooks = append(hooks, state.rewriteHooks...)
+	if len(hooks) > 0 {
+		serveAPIProxy(ctx, listener, dial, hooks)
+	} else {
+		serveTunnel(ctx, listener, dial)
+	}
 	state.listener = listener
+	state.dockerHost = dockerHost(listener.Addr())
+	state.cleanup = append(state.cleanup, func() { listener.Close() })
 }
 
 func useSSHClientExternal() {
@@ -213,37 +608,50 @@ func useSSHClientExternal() {
 		CommandExtraArgs: flags.SSHExternalClientExtraArgs,
 		Backoff:          flags.BackoffConfig,
 	}
+	if state.listenAddr.Network() != "tcp" {
+		log.Fatal("error: external ssh clients only support tcp listen addresses")
+	}
 	listener, errCh, err := sshtunnelExec.Listen(
-		&net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
+		state.listenAddr,
 		flags.RemoteSocketAddr,
 		tunnelConfig,
 	)
 	if err != nil {
-		log.Fatalf("tunnel connection failed: %v", err)
+		fatalTunnelf("tunnel connection failed: %v", err)
 	}
 	go func() {
-		err, ok := <-errCh
-		if !ok {
-			return
+		for err := range errCh {
+			if !flags.Resilient {
+				tunnelFailed(err)
+				return
+			}
+			log.Printf("warning: tunnel: %v", err)
 		}
-		log.Fatalf("tunnel connection failed: %v", err)
 	}()
 	state.listener = listener
+	state.dockerHost = dockerHost(listener.Addr())
+	state.cleanup = append(state.cleanup, func() { listener.Close() })
 }
 
 func main() {
-	signals := make(chan os.Signal)
+	start()
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	go func() {
-		s := <-signals
-		log.Printf("received %v signal, shutting down", s)
-		state.listener.Close()
-	}()
 
 	if flags.Verbose {
-		log.Printf("forwarding %v to socket %q on %v", state.listener.Addr(), flags.RemoteSocketAddr, flags.SSHAddr)
+		log.Printf("forwarding %v to socket %q on %v", state.dockerHost, flags.RemoteSocketAddr, flags.SSHAddr)
 	}
-	envKeyValuePair := fmt.Sprintf("%v=tcp://%v", flags.EnvVarName, state.listener.Addr())
+	if state.controlListener != nil {
+		exitCode := runControlMaster(signals)
+		runCleanup()
+		os.Exit(exitCode)
+	}
+	if flags.Daemon {
+		exitCode := runDaemon(signals)
+		runCleanup()
+		os.Exit(exitCode)
+	}
+	envKeyValuePair := fmt.Sprintf("%v=%v", flags.EnvVarName, state.dockerHost)
 
 	cmd := exec.Command(flags.CommandName, flags.CommandArgs...)
 	if flags.Verbose {
@@ -254,10 +662,10 @@ func main() {
 	cmd.Stdin = os.Stdin
 	cmd.Env = append(cmd.Env, os.Environ()...)
 	cmd.Env = append(cmd.Env, envKeyValuePair)
-	if err := cmd.Run(); err != nil {
-		nonzeroExit = true
-	}
-	if nonzeroExit {
-		os.Exit(1)
+	if state.childAgentSock != "" {
+		cmd.Env = append(cmd.Env, "SSH_AUTH_SOCK="+state.childAgentSock)
 	}
+	exitCode := runCommand(cmd, signals)
+	runCleanup()
+	os.Exit(exitCode)
 }
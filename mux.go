@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// OpenSSH ControlMaster multiplexing protocol (PROTOCOL.mux in the OpenSSH sources).
+const (
+	muxMsgHello          = 0x00000001
+	muxCAliveCheck       = 0x10000004
+	muxCOpenFwd          = 0x10000006
+	muxCCloseFwd         = 0x10000007
+	muxSOK               = 0x80000001
+	muxSPermissionDenied = 0x80000002
+	muxSFailure          = 0x80000003
+	muxSAlive            = 0x80000005
+	muxFwdLocal          = 1
+	muxProtocolVersion   = 4
+	muxPortStreamLocal   = 0xfffffffe // PORT_STREAMLOCAL (-2)
+	muxMaxPacketSize     = 256 * 1024
+	muxRequestID         = 1
+)
+
+// muxConn is a connection to an OpenSSH master's control socket.
+type muxConn struct {
+	*net.UnixConn
+}
+
+// dialMux connects to the OpenSSH master at controlPath and exchanges hello messages.
+func dialMux(controlPath string) (*muxConn, error) {
+	conn, err := net.Dial("unix", controlPath)
+	if err != nil {
+		return nil, fmt.Errorf("connect to OpenSSH master: %v", err)
+	}
+	m := &muxConn{conn.(*net.UnixConn)}
+	if err := m.writePacket(muxPacket{}.uint32(muxMsgHello).uint32(muxProtocolVersion)); err != nil {
+		m.Close()
+		return nil, err
+	}
+	hello, err := m.readPacket()
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	msgType, _ := hello.readUint32()
+	version, err := hello.readUint32()
+	if err != nil || msgType != muxMsgHello {
+		m.Close()
+		return nil, errors.New("OpenSSH master: unexpected hello message")
+	}
+	if version != muxProtocolVersion {
+		m.Close()
+		return nil, fmt.Errorf("OpenSSH master: unsupported protocol version %d", version)
+	}
+	return m, nil
+}
+
+// aliveCheck asks the master for its PID.
+func (m *muxConn) aliveCheck() (int, error) {
+	if err := m.writePacket(muxPacket{}.uint32(muxCAliveCheck).uint32(muxRequestID)); err != nil {
+		return 0, err
+	}
+	reply, err := m.readReply(muxRequestID)
+	if err != nil {
+		return 0, err
+	}
+	if reply.msgType != muxSAlive {
+		return 0, fmt.Errorf("OpenSSH master: unexpected reply %#x", reply.msgType)
+	}
+	pid, err := reply.body.readUint32()
+	return int(pid), err
+}
+
+// forwardStreamLocal asks the master to set up (muxCOpenFwd) or cancel (muxCCloseFwd) the forwarding
+// of the local socket at localPath to the remote socket at remotePath, like ssh -O forward -L localPath:remotePath.
+func (m *muxConn) forwardStreamLocal(msgType uint32, localPath, remotePath string) error {
+	request := muxPacket{}.uint32(msgType).uint32(muxRequestID).uint32(muxFwdLocal).
+		string(localPath).uint32(muxPortStreamLocal).
+		string(remotePath).uint32(muxPortStreamLocal)
+	if err := m.writePacket(request); err != nil {
+		return err
+	}
+	reply, err := m.readReply(muxRequestID)
+	if err != nil {
+		return err
+	}
+	if reply.msgType != muxSOK {
+		return fmt.Errorf("OpenSSH master: unexpected reply %#x", reply.msgType)
+	}
+	return nil
+}
+
+type muxReply struct {
+	msgType uint32
+	body    *muxPacket
+}
+
+// readReply reads a reply to the given request, turning failure replies into errors.
+func (m *muxConn) readReply(requestID uint32) (*muxReply, error) {
+	packet, err := m.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	msgType, _ := packet.readUint32()
+	replyID, err := packet.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if replyID != requestID {
+		return nil, fmt.Errorf("OpenSSH master: reply to unexpected request %d", replyID)
+	}
+	switch msgType {
+	case muxSPermissionDenied:
+		reason, _ := packet.readString()
+		return nil, fmt.Errorf("OpenSSH master: permission denied: %s", reason)
+	case muxSFailure:
+		reason, _ := packet.readString()
+		return nil, fmt.Errorf("OpenSSH master: %s", reason)
+	}
+	return &muxReply{msgType: msgType, body: packet}, nil
+}
+
+func (m *muxConn) writePacket(p muxPacket) error {
+	buf := make([]byte, 4, 4+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	if _, err := m.Write(append(buf, p...)); err != nil {
+		return fmt.Errorf("write to OpenSSH master: %v", err)
+	}
+	return nil
+}
+
+func (m *muxConn) readPacket() (*muxPacket, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(m, length[:]); err != nil {
+		return nil, fmt.Errorf("read from OpenSSH master: %v", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > muxMaxPacketSize {
+		return nil, fmt.Errorf("read from OpenSSH master: packet too large (%d bytes)", n)
+	}
+	packet := make(muxPacket, n)
+	if _, err := io.ReadFull(m, packet); err != nil {
+		return nil, fmt.Errorf("read from OpenSSH master: %v", err)
+	}
+	return &packet, nil
+}
+
+// muxPacket is the payload of a mux protocol packet.
+type muxPacket []byte
+
+func (p muxPacket) uint32(v uint32) muxPacket {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(p, buf[:]...)
+}
+
+func (p muxPacket) string(s string) muxPacket {
+	return append(p.uint32(uint32(len(s))), s...)
+}
+
+func (p *muxPacket) readUint32() (uint32, error) {
+	if len(*p) < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := binary.BigEndian.Uint32(*p)
+	*p = (*p)[4:]
+	return v, nil
+}
+
+func (p *muxPacket) readString() (string, error) {
+	n, err := p.readUint32()
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(*p)) < n {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string((*p)[:n])
+	*p = (*p)[n:]
+	return s, nil
+}
+
+// openSSHMuxDialer asks the OpenSSH master listening on controlPath to forward a socket in a
+// private temporary directory to the remote socket, and returns a function that connects to it.
+// No new SSH connection (or authentication) is needed. The forwarding is cancelled on exit.
+func openSSHMuxDialer(controlPath string) (func(context.Context) (net.Conn, error), error) {
+	m, err := dialMux(controlPath)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	pid, err := m.aliveCheck()
+	if err != nil {
+		return nil, err
+	}
+	if flags.Verbose {
+		log.Printf("using OpenSSH master (pid %d) at %s", pid, controlPath)
+	}
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		return nil, fmt.Errorf("create socket directory: %v", err)
+	}
+	state.cleanup = append(state.cleanup, func() { os.RemoveAll(dir) })
+	localPath := filepath.Join(dir, "mux.sock")
+	if err := m.forwardStreamLocal(muxCOpenFwd, localPath, flags.RemoteSocketAddr); err != nil {
+		return nil, err
+	}
+	state.cleanup = append(state.cleanup, func() {
+		m, err := dialMux(controlPath)
+		if err != nil {
+			return
+		}
+		defer m.Close()
+		m.forwardStreamLocal(muxCCloseFwd, localPath, flags.RemoteSocketAddr)
+	})
+	return func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", localPath)
+	}, nil
+}
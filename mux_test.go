@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestMux serves a single connection on a new control socket in dir like an OpenSSH master with
+// the given protocol version, replying to each request with the packet returned by reply.
+func serveTestMux(t *testing.T, dir string, version uint32, reply func(request *muxPacket) muxPacket) string {
+	controlPath := filepath.Join(dir, "control")
+	listener, err := net.Listen("unix", controlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		m := &muxConn{conn.(*net.UnixConn)}
+		if _, err := m.readPacket(); err != nil {
+			return
+		}
+		if m.writePacket(muxPacket{}.uint32(muxMsgHello).uint32(version)) != nil {
+			return
+		}
+		for {
+			request, err := m.readPacket()
+			if err != nil {
+				return
+			}
+			if m.writePacket(reply(request)) != nil {
+				return
+			}
+		}
+	}()
+	return controlPath
+}
+
+func testMuxDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMuxAliveCheck(t *testing.T) {
+	dir := testMuxDir(t)
+	defer os.RemoveAll(dir)
+	controlPath := serveTestMux(t, dir, muxProtocolVersion, func(request *muxPacket) muxPacket {
+		msgType, _ := request.readUint32()
+		requestID, _ := request.readUint32()
+		if msgType != muxCAliveCheck {
+			return muxPacket{}.uint32(muxSFailure).uint32(requestID).string("unexpected request")
+		}
+		return muxPacket{}.uint32(muxSAlive).uint32(requestID).uint32(1234)
+	})
+	m, err := dialMux(controlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pid, err := m.aliveCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != 1234 {
+		t.Errorf("aliveCheck() = %d, want 1234", pid)
+	}
+}
+
+func TestMuxUnsupportedVersion(t *testing.T) {
+	dir := testMuxDir(t)
+	defer os.RemoveAll(dir)
+	controlPath := serveTestMux(t, dir, muxProtocolVersion+1, nil)
+	if _, err := dialMux(controlPath); err == nil || !strings.Contains(err.Error(), "unsupported protocol version") {
+		t.Errorf("dialMux() error = %v, want an unsupported version error", err)
+	}
+}
+
+func TestMuxForwardStreamLocal(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   uint32
+		replyID uint32
+		wantErr string
+	}{
+		{name: "ok", reply: muxSOK, replyID: muxRequestID},
+		{name: "permission denied", reply: muxSPermissionDenied, replyID: muxRequestID, wantErr: "permission denied: reason"},
+		{name: "failure", reply: muxSFailure, replyID: muxRequestID, wantErr: "OpenSSH master: reason"},
+		{name: "unexpected reply", reply: muxSAlive, replyID: muxRequestID, wantErr: "unexpected reply"},
+		{name: "unexpected request id", reply: muxSOK, replyID: muxRequestID + 1, wantErr: "unexpected request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testMuxDir(t)
+			defer os.RemoveAll(dir)
+			requests := make(chan []interface{}, 1)
+			controlPath := serveTestMux(t, dir, muxProtocolVersion, func(p *muxPacket) muxPacket {
+				var request []interface{}
+				for _, read := range []func() (interface{}, error){
+					func() (interface{}, error) { return p.readUint32() },
+					func() (interface{}, error) { return p.readUint32() },
+					func() (interface{}, error) { return p.readUint32() },
+					func() (interface{}, error) { return p.readString() },
+					func() (interface{}, error) { return p.readUint32() },
+					func() (interface{}, error) { return p.readString() },
+					func() (interface{}, error) { return p.readUint32() },
+				} {
+					v, _ := read()
+					request = append(request, v)
+				}
+				requests <- request
+				return muxPacket{}.uint32(tt.reply).uint32(tt.replyID).string("reason")
+			})
+			m, err := dialMux(controlPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			err = m.forwardStreamLocal(muxCOpenFwd, "/tmp/local.sock", "/var/run/docker.sock")
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("forwardStreamLocal() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("forwardStreamLocal() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+			request := <-requests
+			want := []interface{}{
+				uint32(muxCOpenFwd), uint32(muxRequestID), uint32(muxFwdLocal),
+				"/tmp/local.sock", uint32(muxPortStreamLocal),
+				"/var/run/docker.sock", uint32(muxPortStreamLocal),
+			}
+			for i := range want {
+				if request[i] != want[i] {
+					t.Errorf("request field %d = %v, want %v", i, request[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMuxPacket(t *testing.T) {
+	p := muxPacket{}.uint32(7).string("abc").string("")
+	if got, err := p.readUint32(); got != 7 || err != nil {
+		t.Errorf("readUint32() = %d, %v, want 7", got, err)
+	}
+	if got, err := p.readString(); got != "abc" || err != nil {
+		t.Errorf("readString() = %q, %v, want abc", got, err)
+	}
+	if got, err := p.readString(); got != "" || err != nil {
+		t.Errorf("readString() = %q, %v, want the empty string", got, err)
+	}
+	if _, err := p.readUint32(); err == nil {
+		t.Error("readUint32() of an empty packet: error = nil")
+	}
+	truncated := muxPacket{}.uint32(10).string("abc")[:6]
+	if _, err := truncated.readString(); err == nil {
+		t.Error("readString() of a truncated packet: error = nil")
+	}
+}
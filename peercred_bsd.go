@@ -0,0 +1,61 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// solLocal and localPeerCred are SOL_LOCAL and LOCAL_PEERCRED of <sys/un.h>.
+	solLocal      = 0
+	localPeerCred = 1
+	// xucredVersion is XUCRED_VERSION of <sys/ucred.h>.
+	xucredVersion = 0
+)
+
+// xucred is struct xucred of <sys/ucred.h> (with the FreeBSD cr_pid field as padding).
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	_       int16
+	groups  [16]uint32
+	_       [8]byte
+}
+
+// peerCredentials returns the uid and (primary) gid of the process at the other end of a Unix socket connection.
+func peerCredentials(conn net.Conn) (uid, gid int, ok bool, err error) {
+	unixConn, isUnix := conn.(*net.UnixConn)
+	if !isUnix {
+		return -1, -1, false, nil
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, -1, false, err
+	}
+	var cred xucred
+	var errSockopt error
+	err = rawConn.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(cred))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerCred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			errSockopt = errno
+		}
+	})
+	if err == nil {
+		err = errSockopt
+	}
+	if err == nil && (cred.version != xucredVersion || cred.ngroups < 1) {
+		err = fmt.Errorf("unexpected xucred (version %d, %d groups)", cred.version, cred.ngroups)
+	}
+	if err != nil {
+		return -1, -1, false, fmt.Errorf("get peer credentials: %v", err)
+	}
+	return int(cred.uid), int(cred.groups[0]), true, nil
+}
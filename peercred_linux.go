@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the uid and gid of the process at the other end of a Unix socket connection.
+func peerCredentials(conn net.Conn) (uid, gid int, ok bool, err error) {
+	unixConn, isUnix := conn.(*net.UnixConn)
+	if !isUnix {
+		return -1, -1, false, nil
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, -1, false, err
+	}
+	var ucred *syscall.Ucred
+	var errSockopt error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, errSockopt = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = errSockopt
+	}
+	if err != nil {
+		return -1, -1, false, fmt.Errorf("get peer credentials: %v", err)
+	}
+	return int(ucred.Uid), int(ucred.Gid), true, nil
+}
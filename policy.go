@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// defaultRegistry is the registry of image names without a registry host name.
+const defaultRegistry = "docker.io"
+
+// policy is a set of rules for the Docker API requests passing through the tunnel (-policy-file).
+type policy struct {
+	// Rules are matched against each request in order, and the first matching rule decides.
+	// Requests that match no rule are allowed. Allowed requests are still subject to the checks below.
+	Rules []policyRule `json:"rules"`
+	// DenyPrivileged denies creating privileged containers and exec sessions.
+	DenyPrivileged bool `json:"denyPrivileged"`
+	// DenyHostNetwork denies creating containers in the host's network namespace.
+	DenyHostNetwork bool `json:"denyHostNetwork"`
+	// AllowedBindSources, if set, are the only (remote) directories that may be bind-mounted,
+	// along with their contents.
+	AllowedBindSources []string `json:"allowedBindSources"`
+	// AllowedRegistries, if set, are the only registries that images may be pulled from,
+	// and that the images of created containers may be from.
+	AllowedRegistries []string `json:"allowedRegistries"`
+}
+
+// policyRule matches Docker API requests by method and path.
+type policyRule struct {
+	// Action is "allow" or "deny".
+	Action string `json:"action"`
+	// Methods are the HTTP methods matched (default: any).
+	Methods []string `json:"methods"`
+	// Mutating restricts the rule to requests other than GET and HEAD.
+	Mutating bool `json:"mutating"`
+	// Paths are path.Match patterns of the API paths matched, without the version prefix
+	// (e.g. /containers/*/exec) (default: any).
+	Paths []string `json:"paths"`
+	// Message is returned for denied requests.
+	Message string `json:"message"`
+}
+
+// readPolicyFile reads and checks a policy file.
+func readPolicyFile(path string) (*policy, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	var p policy
+	if err := decoder.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &p, nil
+}
+
+func (p *policy) check() error {
+	for i, rule := range p.Rules {
+		if rule.Action != policyAllow && rule.Action != policyDeny {
+			return fmt.Errorf("rule %d: action must be %q or %q, not %q", i+1, policyAllow, policyDeny, rule.Action)
+		}
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, "/"); err != nil || !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("rule %d: invalid path pattern %q", i+1, pattern)
+			}
+		}
+	}
+	for i, source := range p.AllowedBindSources {
+		if !strings.HasPrefix(source, "/") {
+			return fmt.Errorf("allowed bind source %q is not an absolute path", source)
+		}
+		p.AllowedBindSources[i] = path.Clean(source)
+	}
+	for i, registry := range p.AllowedRegistries {
+		p.AllowedRegistries[i] = normalizeRegistry(registry)
+	}
+	return nil
+}
+
+// matches returns whether the rule matches a request with the given method and path.
+func (r *policyRule) matches(method, apiPath string) bool {
+	if r.Mutating && (method == http.MethodGet || method == http.MethodHead) {
+		return false
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, method) {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range r.Paths {
+		if matchPath(pattern, apiPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Request denies the request if a deny rule matches it, or if it creates a container, exec
+// session, volume or image that the policy does not allow.
+func (p *policy) Request(ctx context.Context, req *apiRequest) error {
+	apiPath := req.Path
+	for _, rule := range p.Rules {
+		if !rule.matches(req.Method, apiPath) {
+			continue
+		}
+		if rule.Action == policyDeny {
+			message := rule.Message
+			if message == "" {
+				message = fmt.Sprintf("%s %s is not allowed", req.Method, apiPath)
+			}
+			return p.deny(req, http.StatusForbidden, message)
+		}
+		break
+	}
+	if req.Method != http.MethodPost {
+		return nil
+	}
+	var check func([]byte) string
+	switch {
+	case apiPath == "/containers/create":
+		check = p.checkContainer
+	case matchPath("/containers/*/exec", apiPath):
+		check = p.checkExec
+	case apiPath == "/volumes/create":
+		check = p.checkVolume
+	case apiPath == "/images/create":
+		if message := p.checkPull(req); message != "" {
+			return p.deny(req, http.StatusForbidden, message)
+		}
+		return nil
+	default:
+		return nil
+	}
+	if req.JSON == nil {
+		if req.ContentLength == 0 {
+			return nil
+		}
+		return p.deny(req, http.StatusBadRequest, "the request body must be JSON of at most 1 MiB")
+	}
+	if message := check(req.JSON); message != "" {
+		return p.deny(req, http.StatusForbidden, message)
+	}
+	return nil
+}
+
+// Response does nothing.
+func (p *policy) Response(ctx context.Context, req *apiRequest, resp *apiResponse) error {
+	return nil
+}
+
+func (p *policy) deny(req *apiRequest, statusCode int, message string) error {
+	log.Printf("denied %s %s: %s", req.Method, req.URL.RequestURI(), message)
+	return &apiError{StatusCode: statusCode, Message: "denied by policy: " + message}
+}
+
+// checkContainer returns why the given container create request is not allowed, or "" if it is.
+func (p *policy) checkContainer(body []byte) string {
+	var config struct {
+		Image      string
+		HostConfig struct {
+			Privileged  bool
+			NetworkMode string
+			Binds       []string
+			Mounts      []struct {
+				Type          string
+				Source        string
+				VolumeOptions struct {
+					DriverConfig struct {
+						Options map[string]string
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return fmt.Sprintf("invalid request body: %v", err)
+	}
+	if p.DenyPrivileged && config.HostConfig.Privileged {
+		return "privileged containers are not allowed"
+	}
+	if p.DenyHostNetwork && config.HostConfig.NetworkMode == "host" {
+		return "host network mode is not allowed"
+	}
+	if message := p.checkImage(config.Image); message != "" {
+		return message
+	}
+	for _, bind := range config.HostConfig.Binds {
+		source, _ := splitBind(bind)
+		if message := p.checkBindSource(source); message != "" {
+			return message
+		}
+	}
+	for _, mount := range config.HostConfig.Mounts {
+		switch mount.Type {
+		case "bind":
+			if message := p.checkBindSource(mount.Source); message != "" {
+				return message
+			}
+		case "volume":
+			if message := p.checkVolumeOptions(mount.VolumeOptions.DriverConfig.Options); message != "" {
+				return message
+			}
+		}
+	}
+	return ""
+}
+
+// checkExec returns why the given exec create request is not allowed, or "" if it is.
+func (p *policy) checkExec(body []byte) string {
+	var config struct {
+		Privileged bool
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return fmt.Sprintf("invalid request body: %v", err)
+	}
+	if p.DenyPrivileged && config.Privileged {
+		return "privileged exec sessions are not allowed"
+	}
+	return ""
+}
+
+// checkVolume returns why the given volume create request is not allowed, or "" if it is.
+func (p *policy) checkVolume(body []byte) string {
+	var config struct {
+		DriverOpts map[string]string
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return fmt.Sprintf("invalid request body: %v", err)
+	}
+	return p.checkVolumeOptions(config.DriverOpts)
+}
+
+// checkVolumeOptions checks the device of volumes of the local driver that are bind mounts
+// (type=none,o=bind,device=/path) like the sources of bind mounts.
+func (p *policy) checkVolumeOptions(options map[string]string) string {
+	device := options["device"]
+	if !strings.HasPrefix(device, "/") {
+		return ""
+	}
+	return p.checkBindSource(device)
+}
+
+// checkBindSource returns why the given bind mount source is not allowed, or "" if it is.
+// Sources that are not absolute paths are volume names.
+func (p *policy) checkBindSource(source string) string {
+	if len(p.AllowedBindSources) == 0 || !strings.HasPrefix(source, "/") {
+		return ""
+	}
+	source = path.Clean(source)
+	for _, allowed := range p.AllowedBindSources {
+		if source == allowed || strings.HasPrefix(source, strings.TrimSuffix(allowed, "/")+"/") {
+			return ""
+		}
+	}
+	return fmt.Sprintf("bind mount of %s is not allowed", source)
+}
+
+// checkPull returns why the given image create (pull or import) request is not allowed, or "" if it is.
+func (p *policy) checkPull(req *apiRequest) string {
+	if len(p.AllowedRegistries) == 0 {
+		return ""
+	}
+	query := req.URL.Query()
+	if query.Get("fromSrc") != "" {
+		return "importing images is not allowed"
+	}
+	return p.checkImage(query.Get("fromImage"))
+}
+
+// checkImage returns why the given image name is not allowed, or "" if it is.
+func (p *policy) checkImage(image string) string {
+	if len(p.AllowedRegistries) == 0 {
+		return ""
+	}
+	registry := imageRegistry(image)
+	for _, allowed := range p.AllowedRegistries {
+		if registry == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("image %s is not from an allowed registry (registry %s)", image, registry)
+}
+
+// imageRegistry returns the registry host name of the given image name, following the rules of
+// the Docker CLI: the first component of the name is a registry if it contains a dot or a colon,
+// is "localhost", or has upper case letters.
+func imageRegistry(image string) string {
+	i := strings.IndexByte(image, '/')
+	if i < 0 {
+		return defaultRegistry
+	}
+	domain := image[:i]
+	if !strings.ContainsAny(domain, ".:") && domain != "localhost" && strings.ToLower(domain) == domain {
+		return defaultRegistry
+	}
+	return normalizeRegistry(domain)
+}
+
+// normalizeRegistry maps the alternative names of Docker Hub to defaultRegistry.
+func normalizeRegistry(registry string) string {
+	registry = strings.ToLower(registry)
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io":
+		return defaultRegistry
+	}
+	return registry
+}
+
+// matchPath returns whether the path matches the path.Match pattern.
+func matchPath(pattern, apiPath string) bool {
+	ok, _ := path.Match(pattern, apiPath)
+	return ok
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testAPIRequest returns the apiRequest for the given method, URL and JSON body (if not empty).
+func testAPIRequest(t *testing.T, method, target, body string) *apiRequest {
+	httpReq := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	req, err := readAPIRequest(httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestPolicyRequest(t *testing.T) {
+	p := &policy{
+		Rules: []policyRule{
+			{Action: policyAllow, Methods: []string{"GET"}, Paths: []string{"/containers/*/logs"}},
+			{Action: policyDeny, Paths: []string{"/containers/*/logs", "/swarm/*"}, Message: "no"},
+			{Action: policyDeny, Mutating: true, Paths: []string{"/networks/*"}},
+		},
+		DenyPrivileged:     true,
+		DenyHostNetwork:    true,
+		AllowedBindSources: []string{"/srv/data/"},
+		AllowedRegistries:  []string{"registry.example.com", "index.docker.io"},
+	}
+	if err := p.check(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		// wantStatus is the status code of the denial, or 0 if the request is allowed.
+		wantStatus int
+	}{
+		{name: "no rule", method: "GET", target: "/v1.41/info"},
+		{name: "allow rule first", method: "GET", target: "/v1.41/containers/abc/logs"},
+		{name: "deny rule", method: "POST", target: "/v1.41/containers/abc/logs", wantStatus: http.StatusForbidden},
+		{name: "deny rule without version", method: "POST", target: "/swarm/init", wantStatus: http.StatusForbidden},
+		{name: "deny rule with odd version", method: "POST", target: "/v.1/swarm/init", wantStatus: http.StatusForbidden},
+		{name: "deny rule with unclean path", method: "POST", target: "//v1.41/swarm/../swarm/init", wantStatus: http.StatusForbidden},
+		{name: "mutating rule, GET", method: "GET", target: "/v1.41/networks/abc"},
+		{name: "mutating rule, DELETE", method: "DELETE", target: "/v1.41/networks/abc", wantStatus: http.StatusForbidden},
+		{name: "container", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine"}`},
+		{name: "container without body", method: "POST", target: "/v1.41/containers/create"},
+		{name: "privileged container", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Privileged":true}}`, wantStatus: http.StatusForbidden},
+		{name: "host network", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"NetworkMode":"host"}}`, wantStatus: http.StatusForbidden},
+		{name: "allowed bind", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Binds":["/srv/data/x:/x:ro","volume:/y"]}}`},
+		{name: "allowed bind of the directory itself", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Binds":["/srv/data:/x"]}}`},
+		{name: "bind outside", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Binds":["/srv/database:/x"]}}`, wantStatus: http.StatusForbidden},
+		{name: "bind escaping with ..", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Binds":["/srv/data/../../etc:/x"]}}`, wantStatus: http.StatusForbidden},
+		{name: "bind mount outside", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Mounts":[{"Type":"bind","Source":"/etc","Target":"/x"}]}}`, wantStatus: http.StatusForbidden},
+		{name: "volume mount binding outside", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{"Mounts":[{"Type":"volume","Source":"v","Target":"/x","VolumeOptions":{"DriverConfig":{"Options":{"type":"none","o":"bind","device":"/etc"}}}}]}}`, wantStatus: http.StatusForbidden},
+		{name: "image from another registry", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"evil.example.com/alpine"}`, wantStatus: http.StatusForbidden},
+		{name: "image from an allowed registry", method: "POST", target: "/v1.41/containers/create", body: `{"Image":"registry.example.com/team/app:1"}`},
+		{name: "invalid body", method: "POST", target: "/v1.41/containers/create", body: `{"Image":1}`, wantStatus: http.StatusForbidden},
+		{name: "privileged exec", method: "POST", target: "/v1.41/containers/abc/exec", body: `{"Cmd":["sh"],"Privileged":true}`, wantStatus: http.StatusForbidden},
+		{name: "exec", method: "POST", target: "/v1.41/containers/abc/exec", body: `{"Cmd":["sh"]}`},
+		{name: "volume binding outside", method: "POST", target: "/v1.41/volumes/create", body: `{"Name":"v","DriverOpts":{"type":"none","o":"bind","device":"/etc"}}`, wantStatus: http.StatusForbidden},
+		{name: "volume binding inside", method: "POST", target: "/v1.41/volumes/create", body: `{"Name":"v","DriverOpts":{"type":"none","o":"bind","device":"/srv/data/v"}}`},
+		{name: "pull from Docker Hub", method: "POST", target: "/v1.41/images/create?fromImage=alpine&tag=latest"},
+		{name: "pull from another registry", method: "POST", target: "/v1.41/images/create?fromImage=evil.example.com%2Falpine", wantStatus: http.StatusForbidden},
+		{name: "import", method: "POST", target: "/v1.41/images/create?fromSrc=-", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Request(context.Background(), testAPIRequest(t, tt.method, tt.target, tt.body))
+			status := 0
+			if err != nil {
+				apiErr, ok := err.(*apiError)
+				if !ok {
+					t.Fatalf("Request() error = %v, want an *apiError", err)
+				}
+				status = apiErr.StatusCode
+			}
+			if status != tt.wantStatus {
+				t.Errorf("Request() status = %d (%v), want %d", status, err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  policy
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "valid rule", policy: policy{Rules: []policyRule{{Action: policyDeny, Paths: []string{"/containers/*/exec"}}}}},
+		{name: "invalid action", policy: policy{Rules: []policyRule{{Action: "reject"}}}, wantErr: true},
+		{name: "relative path pattern", policy: policy{Rules: []policyRule{{Action: policyDeny, Paths: []string{"containers/*"}}}}, wantErr: true},
+		{name: "invalid path pattern", policy: policy{Rules: []policyRule{{Action: policyDeny, Paths: []string{"/containers/["}}}}, wantErr: true},
+		{name: "relative bind source", policy: policy{AllowedBindSources: []string{"srv"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.check(); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "alpine", want: "docker.io"},
+		{image: "alpine:3", want: "docker.io"},
+		{image: "library/alpine", want: "docker.io"},
+		{image: "user/app@sha256:abc", want: "docker.io"},
+		{image: "docker.io/library/alpine", want: "docker.io"},
+		{image: "index.docker.io/library/alpine", want: "docker.io"},
+		{image: "registry-1.docker.io/library/alpine", want: "docker.io"},
+		{image: "registry.example.com/app", want: "registry.example.com"},
+		{image: "Registry.Example.com/app", want: "registry.example.com"},
+		{image: "registry:5000/app", want: "registry:5000"},
+		{image: "localhost/app", want: "localhost"},
+		{image: "Registry/app", want: "registry"},
+		{image: "", want: "docker.io"},
+	}
+	for _, tt := range tests {
+		if got := imageRegistry(tt.image); got != tt.want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
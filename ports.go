@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portForwardRetryInterval is how long to wait before re-subscribing to the remote daemon's events after an error.
+const portForwardRetryInterval = 5 * time.Second
+
+// portForwarder forwards the host ports published by remote containers to local TCP listeners
+// (-auto-forward-ports), for as long as the containers run.
+type portForwarder struct {
+	docker *http.Client
+	dial   dialFunc
+
+	mu       sync.Mutex
+	forwards map[string][]*portForward
+}
+
+// portForward is a local listener forwarding to a host port published by a container.
+type portForward struct {
+	localAddr  string
+	remoteAddr string
+	cancel     context.CancelFunc
+}
+
+// dockerContainer is the part of the remote daemon's container inspect data used for forwarding ports.
+type dockerContainer struct {
+	ID              string `json:"Id"`
+	Name            string
+	NetworkSettings struct {
+		Ports map[string][]struct {
+			HostIP   string `json:"HostIp"`
+			HostPort string
+		}
+	}
+}
+
+// newPortForwarder returns a port forwarder that talks to the remote daemon using dialDocker,
+// and opens connections to published ports using dial.
+func newPortForwarder(dialDocker func(context.Context) (net.Conn, error), dial dialFunc) *portForwarder {
+	return &portForwarder{
+		docker:   dockerAPIClient(dialDocker),
+		dial:     dial,
+		forwards: make(map[string][]*portForward),
+	}
+}
+
+// dockerAPIClient returns an HTTP client for the Docker API that connects using dial.
+// Request URLs are of the form http://docker/path.
+func dockerAPIClient(dial func(context.Context) (net.Conn, error)) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx)
+			},
+		},
+	}
+}
+
+// Run forwards ports until the context is done. Watching the remote daemon's events is
+// resumed after errors (e.g. while the ssh connection is re-established).
+func (f *portForwarder) Run(ctx context.Context) {
+	defer f.stopAll()
+	for {
+		err := f.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("warning: auto-forward-ports: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(portForwardRetryInterval):
+		}
+	}
+}
+
+// watch subscribes to the remote daemon's container events, forwards the ports of the running
+// containers, and then follows the containers being started and stopped.
+func (f *portForwarder) watch(ctx context.Context) error {
+	filters := `{"type":["container"],"event":["start","die"]}`
+	resp, err := f.get(ctx, "/events?filters="+url.QueryEscape(filters))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := f.sync(ctx); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Action string
+			Actor  struct {
+				ID string
+			}
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("events: %v", err)
+		}
+		switch event.Action {
+		case "start":
+			if err := f.forward(ctx, event.Actor.ID); err != nil {
+				log.Printf("warning: auto-forward-ports: %v", err)
+			}
+		case "die":
+			f.stop(event.Actor.ID)
+		}
+	}
+}
+
+// sync forwards the ports of the running containers, and stops forwarding those of containers
+// that are no longer running.
+func (f *portForwarder) sync(ctx context.Context) error {
+	var containers []dockerContainer
+	if err := f.getJSON(ctx, "/containers/json", &containers); err != nil {
+		return err
+	}
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+		if err := f.forward(ctx, container.ID); err != nil {
+			log.Printf("warning: auto-forward-ports: %v", err)
+		}
+	}
+	f.mu.Lock()
+	var stopped []string
+	for id := range f.forwards {
+		if !running[id] {
+			stopped = append(stopped, id)
+		}
+	}
+	f.mu.Unlock()
+	for _, id := range stopped {
+		f.stop(id)
+	}
+	return nil
+}
+
+// forward opens local listeners for the TCP host ports published by the given container.
+// If a port is in use locally, another (random) local port is used instead.
+func (f *portForwarder) forward(ctx context.Context, id string) error {
+	f.mu.Lock()
+	_, ok := f.forwards[id]
+	f.mu.Unlock()
+	if ok {
+		return nil
+	}
+	var container dockerContainer
+	if err := f.getJSON(ctx, "/containers/"+url.PathEscape(id)+"/json", &container); err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(container.Name, "/")
+	var ports []string
+	for port := range container.NetworkSettings.Ports {
+		if strings.HasSuffix(port, "/tcp") {
+			ports = append(ports, port)
+		}
+	}
+	sort.Strings(ports)
+	var forwards []*portForward
+	seen := make(map[string]bool)
+	for _, port := range ports {
+		for _, binding := range container.NetworkSettings.Ports[port] {
+			if binding.HostPort == "" || seen[binding.HostPort] {
+				continue
+			}
+			seen[binding.HostPort] = true
+			remoteHost := binding.HostIP
+			switch remoteHost {
+			case "", "0.0.0.0", "::":
+				remoteHost = "127.0.0.1"
+			}
+			remoteAddr := net.JoinHostPort(remoteHost, binding.HostPort)
+			listener, err := net.Listen("tcp", net.JoinHostPort(flags.LocalListenIP, binding.HostPort))
+			remapped := err != nil
+			if remapped {
+				listener, err = net.Listen("tcp", net.JoinHostPort(flags.LocalListenIP, "0"))
+			}
+			if err != nil {
+				log.Printf("warning: auto-forward-ports: container %s, port %s: %v", name, port, err)
+				continue
+			}
+			forwardCtx, cancel := context.WithCancel(ctx)
+			serveTunnel(forwardCtx, listener, func(ctx context.Context) (net.Conn, error) {
+				return f.dial(ctx, "tcp", remoteAddr)
+			})
+			forward := &portForward{localAddr: listener.Addr().String(), remoteAddr: remoteAddr, cancel: cancel}
+			forwards = append(forwards, forward)
+			if remapped {
+				log.Printf("forwarding %s to %s (container %s, port %s; local port %s is in use)", forward.localAddr, remoteAddr, name, port, binding.HostPort)
+			} else {
+				log.Printf("forwarding %s to %s (container %s, port %s)", forward.localAddr, remoteAddr, name, port)
+			}
+		}
+	}
+	f.mu.Lock()
+	f.forwards[id] = forwards
+	f.mu.Unlock()
+	return nil
+}
+
+// stop closes the local listeners (and connections) of the given container.
+func (f *portForwarder) stop(id string) {
+	f.mu.Lock()
+	forwards := f.forwards[id]
+	delete(f.forwards, id)
+	f.mu.Unlock()
+	for _, forward := range forwards {
+		forward.cancel()
+		log.Printf("stopped forwarding %s to %s", forward.localAddr, forward.remoteAddr)
+	}
+}
+
+func (f *portForwarder) stopAll() {
+	f.mu.Lock()
+	var ids []string
+	for id := range f.forwards {
+		ids = append(ids, id)
+	}
+	f.mu.Unlock()
+	for _, id := range ids {
+		f.stop(id)
+	}
+}
+
+// get sends a GET request to the remote daemon, and returns the response if its status is 200 OK.
+func (f *portForwarder) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.docker.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var message struct {
+			Message string `json:"message"`
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(buf, &message) != nil || message.Message == "" {
+			message.Message = strings.TrimSpace(string(buf))
+		}
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, message.Message)
+	}
+	return resp, nil
+}
+
+func (f *portForwarder) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := f.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// promptRelayEnvVar marks a background process (see startBackground) whose prompts are relayed
+// to the process that started it.
+const promptRelayEnvVar = "WITH_SSH_DOCKER_SOCKET_PROMPT_RELAY"
+
+// errNoPrompt is returned when a prompt is needed, but neither a terminal nor SSH_ASKPASS is available.
+var errNoPrompt = errors.New("cannot prompt: no terminal, and SSH_ASKPASS is not usable")
+
+// promptError is a failure to prompt the user during authentication.
+// Like host key verification failures, it is never retried.
+type promptError struct {
+	err error
+}
+
+func (e *promptError) Error() string {
+	return fmt.Sprintf("authentication: %v", e.err)
+}
+
+// promptMu serializes prompts, and guards relay.
+var promptMu sync.Mutex
+
+// relay, if set, forwards the prompts of this background process to the (foreground) process
+// that started it. It is cleared once the background process has reported readiness.
+var relay *promptRelay
+
+// prompt asks the user for input, on /dev/tty or using the SSH_ASKPASS program.
+// If echo is false, the input is not echoed.
+func prompt(text string, echo bool) (string, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	if relay != nil {
+		return relay.prompt(text, echo)
+	}
+	if useAskpass() {
+		return promptAskpass(text)
+	}
+	tty, err := openTTY()
+	if err != nil {
+		return "", errNoPrompt
+	}
+	defer tty.Close()
+	return tty.prompt(text, echo)
+}
+
+// terminal is the user's terminal (or console).
+type terminal struct {
+	in, out *os.File
+}
+
+func (t *terminal) Close() error {
+	if t.out != t.in {
+		t.out.Close()
+	}
+	return t.in.Close()
+}
+
+// canPrompt returns whether prompt can be used.
+func canPrompt() bool {
+	promptMu.Lock()
+	relayed := relay != nil
+	promptMu.Unlock()
+	if relayed || useAskpass() {
+		return true
+	}
+	tty, err := openTTY()
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
+
+// useAskpass returns whether to prompt using SSH_ASKPASS, following the rules of ssh(1):
+// by default only without a terminal and with $DISPLAY set; SSH_ASKPASS_REQUIRE=prefer uses it
+// even with a terminal, =force even without $DISPLAY, and =never never.
+func useAskpass() bool {
+	if os.Getenv("SSH_ASKPASS") == "" {
+		return false
+	}
+	switch os.Getenv("SSH_ASKPASS_REQUIRE") {
+	case "never":
+		return false
+	case "force":
+		return true
+	case "prefer":
+		return os.Getenv("DISPLAY") != ""
+	}
+	if os.Getenv("DISPLAY") == "" {
+		return false
+	}
+	tty, err := openTTY()
+	if err != nil {
+		return true
+	}
+	tty.Close()
+	return false
+}
+
+func promptAskpass(text string) (string, error) {
+	cmd := exec.Command(os.Getenv("SSH_ASKPASS"), text)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("SSH_ASKPASS: %v", err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// prompt writes the prompt to the terminal and reads a line from it, with echo disabled unless echo is set.
+func (t *terminal) prompt(text string, echo bool) (string, error) {
+	if !echo {
+		restore, err := t.disableEcho()
+		if err != nil {
+			return "", fmt.Errorf("disable terminal echo: %v", err)
+		}
+		defer func() {
+			restore()
+			fmt.Fprintln(t.out)
+		}()
+	}
+	if _, err := fmt.Fprint(t.out, text); err != nil {
+		return "", err
+	}
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := t.in.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err != nil {
+			if len(line) > 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	return string(bytes.TrimRight(line, "\r")), nil
+}
+
+// promptRequest is a prompt sent by a background process to the process that started it.
+type promptRequest struct {
+	Text string `json:"text"`
+	Echo bool   `json:"echo"`
+}
+
+// promptReply is the answer to a promptRequest.
+type promptReply struct {
+	Answer string `json:"answer"`
+	Error  string `json:"error,omitempty"`
+}
+
+// promptRelay sends prompts as backgroundMessages to the process that started this background
+// process, and reads the replies.
+type promptRelay struct {
+	requests *json.Encoder
+	replies  *json.Decoder
+}
+
+// startPromptRelay relays the prompts of this background process via stdout and stdin, if the
+// process that started it offered to answer them (see startBackground).
+func startPromptRelay() {
+	if os.Getenv(promptRelayEnvVar) == "" {
+		return
+	}
+	os.Unsetenv(promptRelayEnvVar)
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	relay = &promptRelay{requests: json.NewEncoder(os.Stdout), replies: json.NewDecoder(os.Stdin)}
+}
+
+func (r *promptRelay) prompt(text string, echo bool) (string, error) {
+	if err := r.requests.Encode(backgroundMessage{Prompt: &promptRequest{Text: text, Echo: echo}}); err != nil {
+		return "", fmt.Errorf("relay prompt: %v", err)
+	}
+	var reply promptReply
+	if err := r.replies.Decode(&reply); err != nil {
+		return "", fmt.Errorf("relay prompt: %v", err)
+	}
+	if reply.Error != "" {
+		return "", errors.New(reply.Error)
+	}
+	return reply.Answer, nil
+}
+
+// answerPrompt answers the relayed prompt by prompting the user, and writes the reply to w.
+func answerPrompt(w io.Writer, request *promptRequest) error {
+	var reply promptReply
+	answer, err := prompt(request.Text, request.Echo)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.Answer = answer
+	return json.NewEncoder(w).Encode(reply)
+}
+
+// readSecret reads a secret from the given file, or from the environment variable with the given name.
+func readSecret(path, envVar string) (*string, error) {
+	switch {
+	case path != "":
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret := string(bytes.TrimRight(buf, "\r\n"))
+		return &secret, nil
+	case envVar != "":
+		secret, ok := os.LookupEnv(envVar)
+		if !ok {
+			return nil, fmt.Errorf("$%s is not set", envVar)
+		}
+		return &secret, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+)
+
+// dialFunc opens a connection to the given address.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyDialer returns a dialFunc that connects through the proxy with the given URL.
+// Supported schemes are socks5 (and socks5h), http and https (CONNECT).
+func proxyDialer(proxyURL string) (dialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy url: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("parse proxy url %q: no host", proxyURL)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSOCKS5(ctx, u, addr)
+		}, nil
+	case "http", "https":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialHTTPConnect(ctx, u, addr)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (supported: socks5, http, https)", u.Scheme)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// dialSOCKS5 connects to addr through the SOCKS5 proxy (RFC 1928).
+// Host names are resolved by the proxy. Username/password authentication (RFC 1929)
+// is used if the URL contains user info.
+func dialSOCKS5(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long: %q", host)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", withDefaultPort(proxy.Host, "1080"))
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s: %v", proxy.Host, err)
+	}
+	const (
+		socksVersion       = 5
+		methodNone         = 0
+		methodUserPassword = 2
+		commandConnect     = 1
+		addrTypeIPv4       = 1
+		addrTypeDomain     = 3
+		addrTypeIPv6       = 4
+	)
+	method := byte(methodNone)
+	if proxy.User != nil {
+		method = methodUserPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return fail(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fail(err)
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return fail(errors.New("no acceptable authentication method"))
+	}
+	if method == methodUserPassword {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fail(errors.New("user name or password too long"))
+		}
+		request := []byte{1, byte(len(user))}
+		request = append(request, user...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return fail(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fail(err)
+		}
+		if reply[1] != 0 {
+			return fail(errors.New("authentication failed"))
+		}
+	}
+	request := []byte{socksVersion, commandConnect, 0}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		request = append(request, addrTypeIPv4)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, addrTypeIPv6)
+		request = append(request, ip.To16()...)
+	} else {
+		request = append(request, addrTypeDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return fail(err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fail(err)
+	}
+	if header[1] != 0 {
+		return fail(fmt.Errorf("connect to %s: request failed (reply code %d)", addr, header[1]))
+	}
+	var boundAddrLength int
+	switch header[3] {
+	case addrTypeIPv4:
+		boundAddrLength = net.IPv4len
+	case addrTypeIPv6:
+		boundAddrLength = net.IPv6len
+	case addrTypeDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fail(err)
+		}
+		boundAddrLength = int(length[0])
+	default:
+		return fail(fmt.Errorf("unknown address type %d", header[3]))
+	}
+	if _, err := io.ReadFull(conn, make([]byte, boundAddrLength+2)); err != nil {
+		return fail(err)
+	}
+	return conn, nil
+}
+
+// dialHTTPConnect connects to addr through the HTTP(S) proxy using the CONNECT method.
+// Basic authentication is used if the URL contains user info.
+func dialHTTPConnect(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	var conn net.Conn
+	var err error
+	if proxy.Scheme == "https" {
+		proxyAddr := withDefaultPort(proxy.Host, "443")
+		conn, err = dialer.DialContext(ctx, "tcp", proxyAddr)
+		if err == nil {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+			err = tlsConn.Handshake()
+			conn = tlsConn
+		}
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", withDefaultPort(proxy.Host, "80"))
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("http proxy: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %v", proxy.Host, err)
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return fail(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return fail(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("connect to %s: %s", addr, response.Status))
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes have already been read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// proxyCommandDialer returns a dialFunc that runs the given ProxyCommand and
+// uses its stdin and stdout as the connection. The address is ignored;
+// the command itself is expected to connect to the right host.
+func proxyCommandDialer(command string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialProxyCommand(ctx, command, addr)
+	}
+}
+
+// dialProxyCommand runs the command like OpenSSH does, using `sh -c "exec <command>"`
+// (on Windows, the command is split into arguments instead). The command is killed once
+// the connection is closed; while the ssh handshake is running, that happens when ctx is done.
+func dialProxyCommand(ctx context.Context, command, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		args, err := shlex.Split(command)
+		if err != nil {
+			return nil, fmt.Errorf("tokenize proxy command %q: %v", command, err)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty proxy command")
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	} else {
+		if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("empty proxy command")
+		}
+		cmd = exec.Command("/bin/sh", "-c", "exec "+command)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("proxy command: %v", err)
+	}
+	return &stdioConn{
+		Reader:      stdout,
+		WriteCloser: stdin,
+		close: func() error {
+			stdin.Close()
+			stdout.Close()
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil
+		},
+		laddr: stdioAddr{network: "exec", addr: "stdio"},
+		raddr: stdioAddr{network: "exec", addr: addr},
+	}, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// serveTestProxy accepts a single connection on a new local listener and passes it to handle.
+// It returns the listener's address.
+func serveTestProxy(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		handle(conn)
+	}()
+	return listener.Addr().String()
+}
+
+// testProxyGreeting is written by the test proxies after a successful connect.
+const testProxyGreeting = "SSH-2.0-test\r\n"
+
+func readTestProxyGreeting(t *testing.T, conn net.Conn) {
+	buf := make([]byte, len(testProxyGreeting))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != testProxyGreeting {
+		t.Errorf("read %q, want %q", buf, testProxyGreeting)
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	tests := []struct {
+		name string
+		user *url.Userinfo
+		addr string
+		// wantRequest is the expected address part of the connect request.
+		wantRequest []byte
+		replyCode   byte
+		wantErr     bool
+	}{
+		{name: "domain", addr: "example.com:22", wantRequest: []byte("\x03\x0bexample.com\x00\x16")},
+		{name: "ipv4", addr: "10.0.0.1:2222", wantRequest: []byte{1, 10, 0, 0, 1, 0x08, 0xae}},
+		{name: "ipv6", addr: "[::1]:22", wantRequest: []byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22}},
+		{name: "password", user: url.UserPassword("user", "secret"), addr: "example.com:22", wantRequest: []byte("\x03\x0bexample.com\x00\x16")},
+		{name: "wrong password", user: url.UserPassword("user", "wrong"), addr: "example.com:22", wantErr: true},
+		{name: "connection refused", addr: "example.com:22", wantRequest: []byte("\x03\x0bexample.com\x00\x16"), replyCode: 5, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyErr := make(chan string, 1)
+			addr := serveTestProxy(t, func(conn net.Conn) {
+				proxyErr <- func() string {
+					greeting := make([]byte, 3)
+					if _, err := io.ReadFull(conn, greeting); err != nil {
+						return err.Error()
+					}
+					method := greeting[2]
+					conn.Write([]byte{5, method})
+					if method == 2 {
+						// RFC 1929: version, user name and password, each with a length byte.
+						auth := bufio.NewReader(io.LimitReader(conn, 2+255+1+255))
+						header := make([]byte, 2)
+						io.ReadFull(auth, header)
+						user := make([]byte, header[1])
+						io.ReadFull(auth, user)
+						length, _ := auth.ReadByte()
+						password := make([]byte, length)
+						if _, err := io.ReadFull(auth, password); err != nil {
+							return err.Error()
+						}
+						if string(user) != "user" || string(password) != "secret" {
+							conn.Write([]byte{1, 1})
+							return ""
+						}
+						conn.Write([]byte{1, 0})
+					}
+					request := make([]byte, 3+len(tt.wantRequest))
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return err.Error()
+					}
+					if !bytes.Equal(request[:3], []byte{5, 1, 0}) || !bytes.Equal(request[3:], tt.wantRequest) {
+						return "unexpected request " + string(request)
+					}
+					conn.Write([]byte{5, tt.replyCode, 0, 1, 127, 0, 0, 1, 0, 22})
+					conn.Write([]byte(testProxyGreeting))
+					return ""
+				}()
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialSOCKS5(ctx, &url.URL{Scheme: "socks5", Host: addr, User: tt.user}, tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialSOCKS5() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				readTestProxyGreeting(t, conn)
+				conn.Close()
+			}
+			if msg := <-proxyErr; msg != "" {
+				t.Errorf("proxy: %s", msg)
+			}
+		})
+	}
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		status   int
+		wantAuth string
+		wantErr  bool
+	}{
+		{name: "connect", status: http.StatusOK},
+		{name: "basic auth", user: url.UserPassword("user", "secret"), status: http.StatusOK, wantAuth: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyErr := make(chan string, 1)
+			addr := serveTestProxy(t, func(conn net.Conn) {
+				proxyErr <- func() string {
+					req, err := http.ReadRequest(bufio.NewReader(conn))
+					if err != nil {
+						return err.Error()
+					}
+					if req.Method != http.MethodConnect || req.Host != "example.com:22" {
+						return "unexpected request " + req.Method + " " + req.Host
+					}
+					if got := req.Header.Get("Proxy-Authorization"); got != tt.wantAuth {
+						return "Proxy-Authorization = " + got
+					}
+					// The greeting is sent with the response, so that it is read into the same buffer.
+					io.WriteString(conn, fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n%s", tt.status, http.StatusText(tt.status), testProxyGreeting))
+					return ""
+				}()
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialHTTPConnect(ctx, &url.URL{Scheme: "http", Host: addr, User: tt.user}, "example.com:22")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialHTTPConnect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				readTestProxyGreeting(t, conn)
+				conn.Close()
+			}
+			if msg := <-proxyErr; msg != "" {
+				t.Errorf("proxy: %s", msg)
+			}
+		})
+	}
+}
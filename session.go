@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sgreben/sshtunnel/backoff"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// aliveTimeout is how long the check whether a session's transport is still usable waits for an answer.
+const aliveTimeout = 10 * time.Second
+
+// session is a long-lived SSH client connection over which tunnelled connections are opened.
+//
+// When the SSH transport dies, the session re-connects (following the back-off configuration)
+// on the next use. Connection failures that exhaust the back-off are reported on Err().
+//
+// A resilient session instead re-connects right away, in the background, and once the first
+// connection has been established, without limit on the number of attempts.
+type session struct {
+	hops      []sshHop
+	backoff   backoff.Config
+	resilient bool
+	errCh     chan error
+
+	// connecting is a semaphore held while a connection is established.
+	connecting chan struct{}
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// lost is the time the connection of a resilient session was lost, while it is re-connecting.
+	lost   time.Time
+	closed bool
+}
+
+func newSession(hops []sshHop, backoffConfig backoff.Config, resilient bool) *session {
+	return &session{
+		hops:       hops,
+		backoff:    backoffConfig,
+		resilient:  resilient,
+		errCh:      make(chan error, 1),
+		connecting: make(chan struct{}, 1),
+	}
+}
+
+// Err returns a channel that receives connection failures that exhausted the back-off.
+func (s *session) Err() <-chan error {
+	return s.errCh
+}
+
+func (s *session) current() *ssh.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// Client returns the session's SSH client, connecting if there is none.
+func (s *session) Client(ctx context.Context) (*ssh.Client, error) {
+	if client := s.current(); client != nil {
+		return client, nil
+	}
+	select {
+	case s.connecting <- struct{}{}:
+		defer func() { <-s.connecting }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if client := s.current(); client != nil {
+		return client, nil
+	}
+	s.mu.Lock()
+	reconnecting := !s.lost.IsZero()
+	s.mu.Unlock()
+	backoffConfig := s.backoff
+	if reconnecting {
+		backoffConfig.MaxAttempts = math.MaxInt32
+	}
+	var client *ssh.Client
+	attempt := 0
+	err := dialBackOff(ctx, backoffConfig, func(ctx context.Context) error {
+		var err error
+		client, err = dialSSHChain(ctx, s.hops)
+		attempt++
+		if err != nil && reconnecting && ctx.Err() == nil {
+			log.Printf("warning: ssh re-connection attempt %d failed: %v", attempt, err)
+		}
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			select {
+			case s.errCh <- err:
+			default:
+			}
+		}
+		return nil, err
+	}
+	s.mu.Lock()
+	s.client = client
+	lost := s.lost
+	s.lost = time.Time{}
+	s.mu.Unlock()
+	if !lost.IsZero() {
+		log.Printf("warning: ssh connection re-established after %v", time.Since(lost).Round(time.Second))
+	}
+	go s.watch(client)
+	return client, nil
+}
+
+// watch drops the client once its transport dies.
+// Resilient sessions then start re-connecting.
+func (s *session) watch(client *ssh.Client) {
+	err := client.Wait()
+	s.mu.Lock()
+	if s.client != client && (s.client != nil || !s.resilient) {
+		s.mu.Unlock()
+		return
+	}
+	s.client = nil
+	reconnect := s.resilient && !s.closed && s.lost.IsZero()
+	if reconnect {
+		s.lost = time.Now()
+	}
+	s.mu.Unlock()
+	if !reconnect {
+		if flags.Verbose {
+			log.Printf("ssh connection closed: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("warning: ssh connection lost (%v), re-connecting", err)
+	} else {
+		log.Printf("warning: ssh connection lost, re-connecting")
+	}
+	go s.Client(context.Background())
+}
+
+// drop closes the client if it is still the session's current one.
+func (s *session) drop(client *ssh.Client) {
+	s.mu.Lock()
+	if s.client == client {
+		s.client = nil
+	}
+	s.mu.Unlock()
+	client.Close()
+}
+
+// Dial opens a tunnelled connection to the remote address over the session.
+// If the SSH transport turns out to be dead, the session is re-connected once.
+func (s *session) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.open(ctx, func(client *ssh.Client) (net.Conn, error) {
+		return client.Dial(network, addr)
+	}, fmt.Sprintf("%s://%s", network, addr))
+}
+
+// open opens a tunnelled connection using the given function.
+// If the SSH transport turns out to be dead, the session is re-connected once.
+func (s *session) open(ctx context.Context, open func(*ssh.Client) (net.Conn, error), description string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := s.Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := open(client)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt > 0 || s.alive(client) {
+			return nil, fmt.Errorf("open %s: %v", description, err)
+		}
+		s.drop(client)
+	}
+}
+
+// alive checks whether the client's transport is still usable. A transport that does not
+// answer within aliveTimeout is considered dead.
+func (s *session) alive(client *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(aliveTimeout):
+		return false
+	}
+}
+
+// Close closes the session's SSH client.
+func (s *session) Close() error {
+	s.mu.Lock()
+	client := s.client
+	s.client = nil
+	s.closed = true
+	s.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
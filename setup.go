@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// setupCommand is the subcommand that installs a dedicated forwarding-only key on the remote host.
+const setupCommand = "setup"
+
+// setupKeyExistsMarker is printed by the remote install script if the key is already authorized.
+const setupKeyExistsMarker = appName + "-key-exists"
+
+// runSetup generates a dedicated key (or uses the existing one at -setup-key-file), installs it
+// in ~/.ssh/authorized_keys on the remote host with options that disable everything but the
+// forwarding of local connections to Unix sockets, and prints a command line and an ssh_config
+// snippet that use the key. OpenSSH cannot restrict the sockets, so the key can reach any
+// Unix socket the remote user can open, not just the Docker socket.
+func runSetup() {
+	switch {
+	case flag.NArg() > 0:
+		log.Fatalf("error: no command may be given with %s", setupCommand)
+	case flags.SSHExternalClient != "" || flags.SSHExternalClientOpenSSH || flags.SSHExternalClientPuTTY:
+		log.Fatalf("error: %s requires the native ssh client", setupCommand)
+	case flags.Transport != transportStreamLocal && flags.Transport != transportDialStdio:
+		log.Fatalf("error: %s supports -transport=%s and -transport=%s", setupCommand, transportStreamLocal, transportDialStdio)
+	}
+	hosts := nativeHosts()
+	target := hosts[len(hosts)-1]
+	keyPath := flags.SetupKeyFile
+	if keyPath == "" {
+		name := regexp.MustCompile(`[^A-Za-z0-9@._-]`).ReplaceAllString(target.Alias, "_")
+		keyPath = expandTilde(fmt.Sprintf("~/.ssh/%s_%s_ed25519", appName, name))
+	}
+	publicKey, err := setupKey(keyPath)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	options, err := setupKeyOptions()
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	line := fmt.Sprintf("%s %s %s", options, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), appName)
+
+	hops := nativeHops(hosts)
+	session := newSession(hops, flags.BackoffConfig, false)
+	client, err := session.Client(context.Background())
+	if err != nil {
+		fatalTunnelf("tunnel connection failed: %v", err)
+	}
+	defer session.Close()
+	installed, err := installAuthorizedKey(client, publicKey, line)
+	if err != nil {
+		log.Fatalf("error: install key on %s: %v", target.Alias, err)
+	}
+	if installed {
+		log.Printf("installed %s on %s@%s: %s", keyPath+".pub", target.User, target.Addr(), line)
+	} else {
+		log.Printf("%s is already authorized on %s@%s (its options are unchanged)", keyPath+".pub", target.User, target.Addr())
+	}
+	log.Printf("warning: the key can forward connections to any Unix socket that %s can open on %s, not just %s", target.User, target.Alias, flags.RemoteSocketAddr)
+	if serverVersion := string(client.ServerVersion()); openSSHVersionBefore(serverVersion, 7, 8) {
+		log.Printf("warning: the server (%s) is older than OpenSSH 7.8, and rejects keys with the permitlisten option; remove it from the key's line in ~/.ssh/authorized_keys", serverVersion)
+	}
+
+	var extraArgs []string
+	for _, jumpHost := range flags.SSHJumpHosts {
+		extraArgs = append(extraArgs, "-J", jumpHost)
+	}
+	if flagsSet["remote-socket-path"] || flagsSet["s"] {
+		extraArgs = append(extraArgs, "-s", flags.RemoteSocketAddr)
+	}
+	if flags.Transport != transportStreamLocal {
+		extraArgs = append(extraArgs, "-transport", flags.Transport)
+	}
+	if flagsSet["dial-stdio-command"] {
+		extraArgs = append(extraArgs, "-dial-stdio-command", flags.DialStdioCommand)
+	}
+	alias := target.Alias + "-docker"
+	fmt.Printf("# Command line:\n%s\n\n", setupCommandLine(append([]string{"-i", keyPath, "-a", flags.SSHAddr}, extraArgs...)))
+	fmt.Printf("# ssh_config snippet (e.g. for ~/.ssh/config):\n")
+	fmt.Printf("Host %s\n", alias)
+	fmt.Printf("  HostName %s\n", target.HostName)
+	fmt.Printf("  User %s\n", target.User)
+	if target.Port != "22" {
+		fmt.Printf("  Port %s\n", target.Port)
+	}
+	if len(target.ProxyJump) > 0 && len(flags.SSHJumpHosts) == 0 {
+		fmt.Printf("  ProxyJump %s\n", strings.Join(target.ProxyJump, ","))
+	}
+	fmt.Printf("  IdentityFile %s\n", keyPath)
+	fmt.Printf("  IdentitiesOnly yes\n\n")
+	fmt.Printf("# Command line using the ssh_config snippet:\n%s\n", setupCommandLine(append([]string{"-a", alias}, extraArgs...)))
+}
+
+// setupCommandLine returns the (shell-quoted) command line that runs `docker ps` with the given options.
+func setupCommandLine(args []string) string {
+	quoted := []string{appName}
+	for _, arg := range args {
+		if regexp.MustCompile(`[^A-Za-z0-9@%+=:,./_-]`).MatchString(arg) {
+			arg = quoteSh(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(append(quoted, "docker", "ps"), " ")
+}
+
+// setupKey returns the public key of the key file at path, generating an ed25519 key if the file does not exist.
+func setupKey(path string) (ssh.PublicKey, error) {
+	if buf, err := ioutil.ReadFile(path); err == nil {
+		publicKey, err := readPublicKeyFile(path + ".pub")
+		if err != nil {
+			publicKey = encryptedKeyPublicKey(buf)
+		}
+		if publicKey == nil {
+			signer, err := ssh.ParsePrivateKey(buf)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			publicKey = signer.PublicKey()
+		}
+		log.Printf("using the existing key %s", path)
+		return publicKey, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostName, _ := os.Hostname()
+	comment := fmt.Sprintf("%s %s@%s", appName, os.Getenv("USER"), hostName)
+	buf, err := marshalOpenSSHKey(privateKey, comment)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		return nil, err
+	}
+	authorizedKey := bytes.TrimSpace(ssh.MarshalAuthorizedKey(publicKey))
+	if err := ioutil.WriteFile(path+".pub", []byte(fmt.Sprintf("%s %s\n", authorizedKey, comment)), 0644); err != nil {
+		return nil, err
+	}
+	log.Printf("generated the key %s (%s)", path, ssh.FingerprintSHA256(publicKey))
+	return publicKey, nil
+}
+
+// setupKeyOptions returns the authorized_keys options of the installed key. The key may only
+// forward local connections; sessions run a forced command: the -dial-stdio-command for
+// -transport=dial-stdio, or else `false`. (Forwarding to Unix sockets is not limited by permitopen.)
+// permitlisten requires OpenSSH 7.8 or later; older versions reject the key.
+func setupKeyOptions() (string, error) {
+	command := "false"
+	if flags.Transport == transportDialStdio {
+		var err error
+		if command, err = renderRemoteCommand(flags.DialStdioCommand); err != nil {
+			return "", err
+		}
+	}
+	command = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(command)
+	return fmt.Sprintf(`restrict,port-forwarding,permitopen="none",permitlisten="none",command="%s"`, command), nil
+}
+
+// openSSHVersionBefore returns whether the SSH server version string is that of OpenSSH
+// older than major.minor.
+func openSSHVersionBefore(serverVersion string, major, minor int) bool {
+	match := regexp.MustCompile(`OpenSSH_(\d+)\.(\d+)`).FindStringSubmatch(serverVersion)
+	if match == nil {
+		return false
+	}
+	serverMajor, _ := strconv.Atoi(match[1])
+	serverMinor, _ := strconv.Atoi(match[2])
+	return serverMajor < major || serverMajor == major && serverMinor < minor
+}
+
+// installAuthorizedKey appends the given authorized_keys line to ~/.ssh/authorized_keys on the
+// remote host, unless the key is already authorized. It returns whether the line was added.
+func installAuthorizedKey(client *ssh.Client, publicKey ssh.PublicKey, line string) (bool, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = os.Stderr
+	blob := strings.Fields(string(ssh.MarshalAuthorizedKey(publicKey)))[1]
+	script := fmt.Sprintf(
+		"umask 077 && mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys && if grep -qF %s ~/.ssh/authorized_keys; then echo %s; else printf '%%s\\n' %s >> ~/.ssh/authorized_keys; fi",
+		quoteSh(blob), setupKeyExistsMarker, quoteSh(line),
+	)
+	if err := session.Run(script); err != nil {
+		return false, err
+	}
+	return !strings.Contains(stdout.String(), setupKeyExistsMarker), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfig is a parsed ssh_config(5) file.
+//
+// Only `Host` sections are supported; `Match` sections never match.
+type sshConfig struct {
+	sections []sshConfigSection
+}
+
+type sshConfigSection struct {
+	// patterns is nil for the options before the first `Host` line, which apply to all hosts.
+	patterns []string
+	match    bool
+	options  []sshConfigOption
+}
+
+type sshConfigOption struct {
+	keyword string
+	args    []string
+	// raw is the unsplit argument string.
+	raw string
+}
+
+// readSSHConfigFiles reads and concatenates the given ssh_config files.
+// Files that do not exist are skipped.
+func readSSHConfigFiles(paths ...string) (*sshConfig, error) {
+	config := &sshConfig{}
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := config.readFile(path, 0, sshConfigSection{}); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// readFile appends the file's sections. Options before the first `Host` line
+// belong to the given enclosing section.
+func (c *sshConfig) readFile(filePath string, depth int, enclosing sshConfigSection) error {
+	const maxIncludeDepth = 16
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many levels of Include", filePath)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.sections = append(c.sections, sshConfigSection{patterns: enclosing.patterns, match: enclosing.match})
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		keyword, args, raw, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filePath, lineNumber, err)
+		}
+		switch keyword {
+		case "":
+			continue
+		case "host":
+			c.sections = append(c.sections, sshConfigSection{patterns: args})
+		case "match":
+			c.sections = append(c.sections, sshConfigSection{patterns: args, match: true})
+		case "include":
+			for _, pattern := range args {
+				pattern = expandTilde(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(filePath), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %v", filePath, lineNumber, err)
+				}
+				current := c.sections[len(c.sections)-1]
+				for _, match := range matches {
+					if err := c.readFile(match, depth+1, current); err != nil {
+						return err
+					}
+				}
+				c.sections = append(c.sections, sshConfigSection{patterns: current.patterns, match: current.match})
+			}
+		default:
+			section := &c.sections[len(c.sections)-1]
+			section.options = append(section.options, sshConfigOption{keyword: keyword, args: args, raw: raw})
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSSHConfigLine splits a line into its lower-cased keyword, its arguments, and the unsplit argument string.
+// Both `Keyword args` and `Keyword=args` forms are accepted; arguments may be double-quoted.
+func splitSSHConfigLine(line string) (string, []string, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, "", nil
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil, "", nil
+	}
+	keyword, rest := strings.ToLower(line[:i]), strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return "", nil, "", fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return keyword, args, rest, nil
+}
+
+// matches reports whether the section applies to the given host alias.
+func (s sshConfigSection) matches(host string) bool {
+	if s.match {
+		return false
+	}
+	if s.patterns == nil {
+		return true
+	}
+	matched := false
+	for _, pattern := range s.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host)); !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Get returns the arguments of the first matching occurrence of the keyword (which must be lower-case).
+func (c *sshConfig) Get(host, keyword string) []string {
+	for _, section := range c.sections {
+		if !section.matches(host) {
+			continue
+		}
+		for _, option := range section.options {
+			if option.keyword == keyword {
+				return option.args
+			}
+		}
+	}
+	return nil
+}
+
+// GetAll returns the arguments of all matching occurrences of the keyword (which must be lower-case).
+func (c *sshConfig) GetAll(host, keyword string) (out []string) {
+	for _, section := range c.sections {
+		if !section.matches(host) {
+			continue
+		}
+		for _, option := range section.options {
+			if option.keyword == keyword {
+				out = append(out, option.args...)
+			}
+		}
+	}
+	return out
+}
+
+// GetRaw returns the unsplit argument string of the first matching occurrence of the keyword (which must be lower-case).
+func (c *sshConfig) GetRaw(host, keyword string) string {
+	for _, section := range c.sections {
+		if !section.matches(host) {
+			continue
+		}
+		for _, option := range section.options {
+			if option.keyword == keyword {
+				return option.raw
+			}
+		}
+	}
+	return ""
+}
+
+// GetString returns the first argument of the first matching occurrence of the keyword, or "".
+func (c *sshConfig) GetString(host, keyword string) string {
+	args := c.Get(host, keyword)
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func expandTilde(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantKeyword string
+		wantArgs    []string
+		wantRaw     string
+		wantErr     bool
+	}{
+		{line: ""},
+		{line: "   "},
+		{line: "# comment"},
+		{line: "  # indented comment"},
+		{line: "Host example", wantKeyword: "host", wantArgs: []string{"example"}, wantRaw: "example"},
+		{line: "\tHostName\t10.0.0.1 ", wantKeyword: "hostname", wantArgs: []string{"10.0.0.1"}, wantRaw: "10.0.0.1"},
+		{line: "Port=2222", wantKeyword: "port", wantArgs: []string{"2222"}, wantRaw: "2222"},
+		{line: "Port = 2222", wantKeyword: "port", wantArgs: []string{"2222"}, wantRaw: "2222"},
+		{line: "Host a b  !c", wantKeyword: "host", wantArgs: []string{"a", "b", "!c"}, wantRaw: "a b  !c"},
+		{line: `IdentityFile "~/my keys/id"`, wantKeyword: "identityfile", wantArgs: []string{"~/my keys/id"}, wantRaw: `"~/my keys/id"`},
+		{line: `ProxyCommand ssh -W %h:%p "jump host"`, wantKeyword: "proxycommand", wantArgs: []string{"ssh", "-W", "%h:%p", "jump host"}, wantRaw: `ssh -W %h:%p "jump host"`},
+		{line: `IdentityFile ""`, wantKeyword: "identityfile", wantArgs: []string{""}, wantRaw: `""`},
+		{line: "Compression", wantKeyword: "compression"},
+		{line: `IdentityFile "~/id`, wantErr: true},
+	}
+	for _, tt := range tests {
+		keyword, args, raw, err := splitSSHConfigLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitSSHConfigLine(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if keyword != tt.wantKeyword || !reflect.DeepEqual(args, tt.wantArgs) || raw != tt.wantRaw {
+			t.Errorf("splitSSHConfigLine(%q) = %q, %q, %q, want %q, %q, %q", tt.line, keyword, args, raw, tt.wantKeyword, tt.wantArgs, tt.wantRaw)
+		}
+	}
+}
+
+func TestSSHConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"config": `
+User everyone
+Include conf.d/*.conf
+
+Host web-* !web-admin
+  HostName %n.example.com
+  Port 2222
+
+Host web-admin
+  User admin
+
+Match host db
+  User nobody
+
+Host *
+  User fallback
+  IdentityFile ~/.ssh/id_a
+  IdentityFile ~/.ssh/id_b
+`,
+		"conf.d/db.conf": `
+Port 2200
+Host db
+  HostName 10.0.0.5
+  ProxyCommand nc -X connect -x "proxy:3128" %h %p
+`,
+		"user_config": `
+Host db
+  User dba
+
+Host app
+  HostName %h.internal
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err := readSSHConfigFiles(filepath.Join(dir, "config"), filepath.Join(dir, "missing"), filepath.Join(dir, "user_config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		keyword string
+		want    string
+	}{
+		{host: "web-1", keyword: "user", want: "everyone"},
+		{host: "web-1", keyword: "hostname", want: "%n.example.com"},
+		{host: "WEB-1", keyword: "port", want: "2200"},
+		{host: "web-admin", keyword: "port", want: "2200"},
+		{host: "web-admin", keyword: "hostname", want: ""},
+		{host: "db", keyword: "hostname", want: "10.0.0.5"},
+		{host: "db", keyword: "user", want: "everyone"},
+		{host: "other", keyword: "port", want: "2200"},
+		{host: "other", keyword: "compression", want: ""},
+	}
+	for _, tt := range tests {
+		if got := config.GetString(tt.host, tt.keyword); got != tt.want {
+			t.Errorf("GetString(%q, %q) = %q, want %q", tt.host, tt.keyword, got, tt.want)
+		}
+	}
+	if got, want := config.GetRaw("db", "proxycommand"), `nc -X connect -x "proxy:3128" %h %p`; got != want {
+		t.Errorf("GetRaw(db, proxycommand) = %q, want %q", got, want)
+	}
+	if got, want := config.GetAll("web-1", "identityfile"), []string{"~/.ssh/id_a", "~/.ssh/id_b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAll(web-1, identityfile) = %q, want %q", got, want)
+	}
+	for _, tt := range []struct {
+		addr string
+		want sshHost
+	}{
+		{addr: "me@corp@web-1", want: sshHost{Alias: "web-1", User: "me@corp", HostName: "web-1.example.com", Port: "2200"}},
+		{addr: "app:2022", want: sshHost{Alias: "app", User: "everyone", HostName: "app.internal", Port: "2022"}},
+	} {
+		got := resolveSSHHost(config, parseSSHHostSpec(tt.addr))
+		if got.Alias != tt.want.Alias || got.User != tt.want.User || got.HostName != tt.want.HostName || got.Port != tt.want.Port {
+			t.Errorf("resolveSSHHost(%q) = %s@%s:%s (alias %s), want %s@%s:%s (alias %s)", tt.addr,
+				got.User, got.HostName, got.Port, got.Alias, tt.want.User, tt.want.HostName, tt.want.Port, tt.want.Alias)
+		}
+	}
+}
+
+func TestSSHConfigIncludeLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte("Include config\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSSHConfigFiles(path); err == nil {
+		t.Error("readSSHConfigFiles() error = nil, want an error")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// stdioConn is a net.Conn over a reader and a writer, such as the stdout and stdin of a command.
+type stdioConn struct {
+	io.Reader
+	io.WriteCloser
+	close     func() error
+	closeOnce sync.Once
+	laddr     stdioAddr
+	raddr     stdioAddr
+}
+
+// stdioAddr is the address of a stdioConn.
+type stdioAddr struct {
+	network string
+	addr    string
+}
+
+func (a stdioAddr) Network() string { return a.network }
+func (a stdioAddr) String() string  { return a.addr }
+
+// CloseWrite closes the writer, signalling EOF to the other side.
+func (c *stdioConn) CloseWrite() error {
+	return c.WriteCloser.Close()
+}
+
+func (c *stdioConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		err = c.close()
+	})
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *stdioConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *stdioConn) SetDeadline(deadline time.Time) error {
+	return errors.New("stdioConn: deadline not supported")
+}
+
+func (c *stdioConn) SetReadDeadline(deadline time.Time) error {
+	return errors.New("stdioConn: deadline not supported")
+}
+
+func (c *stdioConn) SetWriteDeadline(deadline time.Time) error {
+	return errors.New("stdioConn: deadline not supported")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sudoPrompt is the password prompt passed to sudo via {{.SudoPrompt}}.
+	sudoPrompt = appName + "-sudo-password:"
+	// sudoReadyMarker is the line printed via {{.ReadyMarker}} once privileges have been obtained.
+	sudoReadyMarker = appName + "-sudo-ready"
+)
+
+// sudoTimeout is the maximum time to wait for the sudo command to become ready.
+var sudoTimeout = 30 * time.Second
+
+// errSudoPasswordRequired is returned when sudo asks for a password and none is configured.
+var errSudoPasswordRequired = errors.New("sudo on the remote host requires a password (use -remote-sudo-password-file or -remote-sudo-password-env)")
+
+// errSudoPasswordRejected is returned when sudo asks for the password again after it was supplied.
+var errSudoPasswordRejected = errors.New("sudo on the remote host rejected the password")
+
+// sudoPassword returns the password configured via -remote-sudo-password-file or -remote-sudo-password-env, or nil.
+func sudoPassword() ([]byte, error) {
+	switch {
+	case flags.RemoteSudoPasswordFile != "":
+		buf, err := ioutil.ReadFile(flags.RemoteSudoPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("read sudo password: %v", err)
+		}
+		return bytes.TrimRight(buf, "\r\n"), nil
+	case flags.RemoteSudoPasswordEnv != "":
+		password, ok := os.LookupEnv(flags.RemoteSudoPasswordEnv)
+		if !ok {
+			return nil, fmt.Errorf("read sudo password: $%s is not set", flags.RemoteSudoPasswordEnv)
+		}
+		return []byte(password), nil
+	}
+	return nil, nil
+}
+
+// DialSudoCommand is DialCommand for a command that obtains privileges using sudo.
+//
+// The command must print {{.ReadyMarker}} on a line of its own once privileges have been obtained,
+// and must make sudo print {{.SudoPrompt}} when asking for a password. Data from the local
+// connection is only forwarded after the ready marker has been received, so that it is never
+// mistaken for a password.
+func (s *session) DialSudoCommand(ctx context.Context, command string, password []byte) (net.Conn, error) {
+	return s.open(ctx, func(client *ssh.Client) (net.Conn, error) {
+		return dialSudoCommand(client, command, password)
+	}, fmt.Sprintf("session running %q", command))
+}
+
+func dialSudoCommand(client *ssh.Client, command string, password []byte) (net.Conn, error) {
+	sshSession, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (net.Conn, error) {
+		sshSession.Close()
+		return nil, err
+	}
+	stdin, err := sshSession.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stderr, err := sshSession.StderrPipe()
+	if err != nil {
+		return fail(err)
+	}
+	if err := sshSession.Start(command); err != nil {
+		return fail(err)
+	}
+
+	stdoutReader := bufio.NewReader(stdout)
+	readyCh := make(chan error, 1)
+	go func() {
+		for {
+			line, err := stdoutReader.ReadString('\n')
+			if strings.TrimSpace(line) == sudoReadyMarker {
+				readyCh <- nil
+				return
+			}
+			if err != nil {
+				readyCh <- err
+				return
+			}
+		}
+	}()
+
+	// Until the command is ready, stderr is scanned for password prompts; afterwards it is copied to os.Stderr.
+	promptCh := make(chan struct{})
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	stderrDone := make(chan struct{})
+	var stderrBuf bytes.Buffer
+	go func() {
+		defer close(stderrDone)
+		var pending []byte
+		buf := make([]byte, 1024)
+		for {
+			n, err := stderr.Read(buf)
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.Index(pending, []byte(sudoPrompt))
+				if i < 0 {
+					break
+				}
+				stderrBuf.Write(pending[:i])
+				pending = pending[i+len(sudoPrompt):]
+				select {
+				case promptCh <- struct{}{}:
+				case <-done:
+				}
+			}
+			select {
+			case <-ready:
+				os.Stderr.Write(pending)
+				io.Copy(os.Stderr, stderr)
+				return
+			default:
+			}
+			if err != nil {
+				stderrBuf.Write(pending)
+				return
+			}
+		}
+	}()
+
+	timeout := time.NewTimer(sudoTimeout)
+	defer timeout.Stop()
+	passwordSent := false
+	for {
+		select {
+		case <-promptCh:
+			if password == nil {
+				return fail(errSudoPasswordRequired)
+			}
+			if passwordSent {
+				return fail(errSudoPasswordRejected)
+			}
+			if _, err := stdin.Write(append(append([]byte{}, password...), '\n')); err != nil {
+				return fail(err)
+			}
+			passwordSent = true
+		case err := <-readyCh:
+			if err != nil {
+				// Wait for the rest of stderr, answering no more prompts.
+				for waiting := true; waiting; {
+					select {
+					case <-promptCh:
+					case <-stderrDone:
+						waiting = false
+					}
+				}
+				return fail(fmt.Errorf("sudo command exited before becoming ready: %s", strings.TrimSpace(stderrBuf.String())))
+			}
+			close(ready)
+			return &stdioConn{
+				Reader:      stdoutReader,
+				WriteCloser: stdin,
+				close:       sshSession.Close,
+				laddr:       stdioAddr{network: "ssh", addr: client.LocalAddr().String()},
+				raddr:       stdioAddr{network: "ssh", addr: command},
+			}, nil
+		case <-timeout.C:
+			return fail(fmt.Errorf("sudo command did not become ready within %v", sudoTimeout))
+		}
+	}
+}
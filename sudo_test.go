@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialTestSSH returns a client of an SSH server that runs the commands of session channels
+// using run, which returns the exit status.
+func dialTestSSH(t *testing.T, run func(command string, channel ssh.Channel) uint32) *ssh.Client {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newTestSigner(t))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, channels, requests, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		for newChannel := range channels {
+			if newChannel.ChannelType() != "session" {
+				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+				continue
+			}
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for request := range channelRequests {
+					if request.Type != "exec" {
+						request.Reply(false, nil)
+						continue
+					}
+					var payload struct{ Command string }
+					ssh.Unmarshal(request.Payload, &payload)
+					request.Reply(true, nil)
+					go func() {
+						status := run(payload.Command, channel)
+						channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+						channel.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// runTestSudo behaves like the default -remote-sudo-command with sudo asking for the password
+// "secret" (if askPassword is set), and then echoes its input.
+func runTestSudo(askPassword bool) func(command string, channel ssh.Channel) uint32 {
+	return func(command string, channel ssh.Channel) uint32 {
+		input := bufio.NewReader(channel)
+		for attempt := 0; askPassword; attempt++ {
+			if attempt == 3 {
+				io.WriteString(channel.Stderr(), "sudo: 3 incorrect password attempts\n")
+				return 1
+			}
+			io.WriteString(channel.Stderr(), sudoPrompt)
+			password, err := input.ReadString('\n')
+			if err != nil {
+				return 1
+			}
+			if password == "secret\n" {
+				break
+			}
+			io.WriteString(channel.Stderr(), "\nSorry, try again.\n")
+		}
+		io.WriteString(channel, sudoReadyMarker+"\n")
+		io.Copy(channel, input)
+		return 0
+	}
+}
+
+func TestDialSudoCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func(command string, channel ssh.Channel) uint32
+		password string
+		// wantErr is a substring of the expected error, or "" if the command becomes ready.
+		wantErr string
+	}{
+		{name: "no password needed", run: runTestSudo(false)},
+		{name: "no password needed, password given", run: runTestSudo(false), password: "secret"},
+		{name: "password", run: runTestSudo(true), password: "secret"},
+		{name: "password required", run: runTestSudo(true), wantErr: errSudoPasswordRequired.Error()},
+		{name: "password rejected", run: runTestSudo(true), password: "wrong", wantErr: errSudoPasswordRejected.Error()},
+		{
+			name: "exit before ready",
+			run: func(command string, channel ssh.Channel) uint32 {
+				io.WriteString(channel.Stderr(), "sudo: a terminal is required\n")
+				return 1
+			},
+			wantErr: "exited before becoming ready: sudo: a terminal is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTestSSH(t, tt.run)
+			defer client.Close()
+			var password []byte
+			if tt.password != "" {
+				password = []byte(tt.password)
+			}
+			conn, err := dialSudoCommand(client, "sudo", password)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("dialSudoCommand() error = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialSudoCommand() error = %v", err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, "ping\n"); err != nil {
+				t.Fatal(err)
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "ping\n" {
+				t.Errorf("read %q, %v from the connection, want the data written", line, err)
+			}
+		})
+	}
+}
+
+func TestDialSudoCommandTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { sudoTimeout = timeout }(sudoTimeout)
+	sudoTimeout = 100 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	client := dialTestSSH(t, func(command string, channel ssh.Channel) uint32 {
+		<-release
+		return 1
+	})
+	defer client.Close()
+	if _, err := dialSudoCommand(client, "sudo", nil); err == nil || !strings.Contains(err.Error(), "did not become ready") {
+		t.Errorf("dialSudoCommand() error = %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// transportStreamLocal forwards the remote socket using direct-streamlocal@openssh.com channels.
+	transportStreamLocal = "streamlocal"
+	// transportDialStdio runs a remote command (such as `docker system dial-stdio`) in a session
+	// channel for each connection, and pipes the connection through the command's stdin and stdout.
+	transportDialStdio = "dial-stdio"
+	// transportSudo is transportDialStdio with -remote-sudo-command, a command that obtains privileges using sudo.
+	transportSudo = "sudo"
+	// transportOpenSSHMux has a running OpenSSH master connection (ControlMaster) forward the remote
+	// socket, using its control socket.
+	transportOpenSSHMux = "openssh-mux"
+)
+
+// remoteCommandTemplateData is the data available to remote command templates.
+type remoteCommandTemplateData struct {
+	RemoteSocketPath string
+	SudoPrompt       string
+	ReadyMarker      string
+}
+
+// renderRemoteCommand executes a remote command template. Values are quoted for the remote
+// shell using {{quote ...}}.
+func renderRemoteCommand(commandTemplate string) (string, error) {
+	t, err := template.New("").Funcs(template.FuncMap{"quote": quoteSh}).Parse(commandTemplate)
+	if err != nil {
+		return "", fmt.Errorf("parse remote command template %q: %v", commandTemplate, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, remoteCommandTemplateData{
+		RemoteSocketPath: flags.RemoteSocketAddr,
+		SudoPrompt:       sudoPrompt,
+		ReadyMarker:      sudoReadyMarker,
+	}); err != nil {
+		return "", fmt.Errorf("execute remote command template %q: %v", commandTemplate, err)
+	}
+	return buf.String(), nil
+}
+
+// transportDialer returns the function that opens tunnelled connections over the session
+// using the transport selected via -transport.
+func transportDialer(s *session) (func(context.Context) (net.Conn, error), error) {
+	switch flags.Transport {
+	case transportStreamLocal:
+		return func(ctx context.Context) (net.Conn, error) {
+			return s.Dial(ctx, "unix", flags.RemoteSocketAddr)
+		}, nil
+	case transportDialStdio:
+		command, err := renderRemoteCommand(flags.DialStdioCommand)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) (net.Conn, error) {
+			return s.DialCommand(ctx, command)
+		}, nil
+	case transportSudo:
+		command, err := renderRemoteCommand(flags.RemoteSudoCommand)
+		if err != nil {
+			return nil, err
+		}
+		password, err := sudoPassword()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) (net.Conn, error) {
+			return s.DialSudoCommand(ctx, command, password)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q (supported: %s, %s, %s, %s)", flags.Transport, transportStreamLocal, transportDialStdio, transportSudo, transportOpenSSHMux)
+	}
+}
+
+// DialCommand opens a session channel running the given remote command, and returns
+// a connection over the command's stdin and stdout. The command's stderr is copied to os.Stderr.
+func (s *session) DialCommand(ctx context.Context, command string) (net.Conn, error) {
+	return s.open(ctx, func(client *ssh.Client) (net.Conn, error) {
+		return dialCommand(client, command)
+	}, fmt.Sprintf("session running %q", command))
+}
+
+func dialCommand(client *ssh.Client, command string) (net.Conn, error) {
+	sshSession, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := sshSession.StdinPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, err
+	}
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, err
+	}
+	sshSession.Stderr = os.Stderr
+	if err := sshSession.Start(command); err != nil {
+		sshSession.Close()
+		return nil, err
+	}
+	return &stdioConn{
+		Reader:      stdout,
+		WriteCloser: stdin,
+		close:       sshSession.Close,
+		laddr:       stdioAddr{network: "ssh", addr: client.LocalAddr().String()},
+		raddr:       stdioAddr{network: "ssh", addr: command},
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package main
+
+import "errors"
+
+func openTTY() (*terminal, error) {
+	return nil, errors.New("terminal prompts are not supported on this platform")
+}
+
+func (t *terminal) disableEcho() (func(), error) {
+	return nil, errors.New("terminal prompts are not supported on this platform")
+}
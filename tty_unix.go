@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func openTTY() (*terminal, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &terminal{in: tty, out: tty}, nil
+}
+
+// disableEcho turns off echo on the terminal, and returns a function that restores its previous state.
+func (t *terminal) disableEcho() (func(), error) {
+	var termios syscall.Termios
+	if err := termiosIoctl(t.in, ioctlGetTermios, &termios); err != nil {
+		return nil, err
+	}
+	noEcho := termios
+	noEcho.Lflag &^= syscall.ECHO
+	noEcho.Lflag |= syscall.ICANON | syscall.ISIG
+	if err := termiosIoctl(t.in, ioctlSetTermios, &noEcho); err != nil {
+		return nil, err
+	}
+	return func() { termiosIoctl(t.in, ioctlSetTermios, &termios) }, nil
+}
+
+func termiosIoctl(tty *os.File, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
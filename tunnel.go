@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/sgreben/sshtunnel"
+	"github.com/sgreben/sshtunnel/backoff"
+	"github.com/sgreben/sshtunnel/connpipe"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialSSH opens an SSH client connection as configured.
+// If config.SSHConn is set, the SSH connection is established over it.
+//
+// Host key verification failures are returned as *hostKeyError.
+func dialSSH(ctx context.Context, config *sshtunnel.Config) (*ssh.Client, error) {
+	var keyErr error
+	clientConfig := *config.SSHClient
+	clientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := config.SSHClient.HostKeyCallback(hostname, remote, key)
+		if _, ok := err.(*hostKeyError); ok {
+			keyErr = err
+		}
+		return err
+	}
+	conn := config.SSHConn
+	if conn == nil {
+		var dialer net.Dialer
+		var err error
+		conn, err = dialer.DialContext(ctx, "tcp", config.SSHAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(conn, config.SSHAddr, &clientConfig)
+	if keyErr != nil {
+		conn.Close()
+		return nil, keyErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshHop is the configuration of one SSH connection in a chain of jump hosts.
+type sshHop struct {
+	*sshtunnel.Config
+	// Keys are the keys offered to the SSH server.
+	Keys *authKeys
+	// AliveInterval is the interval of keepalive requests (optional).
+	AliveInterval time.Duration
+	// AliveCountMax is the number of unanswered keepalive requests after which the connection is closed.
+	AliveCountMax int
+	// Dial opens the connection to the SSH server of the first hop (optional).
+	Dial dialFunc
+	// Interactive provides password and keyboard-interactive authentication (optional).
+	Interactive *interactiveAuth
+}
+
+// dialSSHChain opens an SSH client connection to the last of the given hops,
+// each hop being reached through a connection to the previous one.
+// Closing the returned client closes the whole chain.
+func dialSSHChain(ctx context.Context, hops []sshHop) (*ssh.Client, error) {
+	var client *ssh.Client
+	for _, hop := range hops {
+		config := hop.Config
+		if hop.Interactive != nil {
+			clientConfig := *config.SSHClient
+			clientConfig.Auth = append(append([]ssh.AuthMethod{}, clientConfig.Auth...), hop.Interactive.Methods()...)
+			configCopy := *config
+			configCopy.SSHClient = &clientConfig
+			config = &configCopy
+		}
+		if client != nil {
+			conn, err := client.Dial("tcp", config.SSHAddr)
+			if err != nil {
+				client.Close()
+				return nil, fmt.Errorf("jump to %s: %v", config.SSHAddr, err)
+			}
+			configCopy := *config
+			configCopy.SSHConn = conn
+			config = &configCopy
+		} else if hop.Dial != nil {
+			conn, err := hop.Dial(ctx, "tcp", config.SSHAddr)
+			if err != nil {
+				return nil, err
+			}
+			configCopy := *config
+			configCopy.SSHConn = conn
+			config = &configCopy
+		}
+		next, err := dialSSH(ctx, config)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			if hop.Interactive != nil {
+				if promptErr := hop.Interactive.PromptError(); promptErr != nil {
+					return nil, promptErr
+				}
+			}
+			if isPermanent(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s: %v", config.SSHAddr, err)
+		}
+		if hop.AliveInterval > 0 {
+			go keepAlive(next, hop.AliveInterval, hop.AliveCountMax)
+		}
+		if client != nil {
+			go func(previous *ssh.Client) {
+				next.Wait()
+				previous.Close()
+			}(client)
+		}
+		client = next
+	}
+	return client, nil
+}
+
+// keepAlive sends keepalive requests over the client connection every interval,
+// and closes it when countMax consecutive requests go unanswered.
+func keepAlive(client *ssh.Client, interval time.Duration, countMax int) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		replyCh := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replyCh <- err
+		}()
+		select {
+		case <-closed:
+			return
+		case err := <-replyCh:
+			if err != nil {
+				client.Close()
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= countMax {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// isPermanent returns whether a connection error must not be retried.
+func isPermanent(err error) bool {
+	switch err.(type) {
+	case *hostKeyError, *promptError:
+		return true
+	}
+	return false
+}
+
+// dialBackOff runs dial with the given back-off configuration.
+// Permanent errors (see isPermanent) are not retried.
+func dialBackOff(ctx context.Context, config backoff.Config, dial func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errPermanent error
+	err := config.Run(ctx, func() error {
+		err := dial(ctx)
+		if isPermanent(err) {
+			errPermanent = err
+			cancel()
+		}
+		return err
+	})
+	if errPermanent != nil {
+		return errPermanent
+	}
+	return err
+}
+
+// dialWithTimeout limits the time dial may take to the given timeout.
+func dialWithTimeout(dial func(context.Context) (net.Conn, error), timeout time.Duration) func(context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		ctxTimeout, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := dial(ctxTimeout)
+		if err != nil && ctx.Err() == nil && ctxTimeout.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("ssh connection not established within %v", timeout)
+		}
+		return conn, err
+	}
+}
+
+// serveTunnel serves tunnelled connections on the given listener.
+// For each accepted connection, a tunnelled connection is opened using dial.
+// Connections for which dial fails are closed, and the error is logged.
+func serveTunnel(ctx context.Context, listener net.Listener, dial func(context.Context) (net.Conn, error)) {
+	handleListenerConn := func(listenerConn net.Conn) {
+		ctxConn, cancel := context.WithCancel(ctx)
+		defer listenerConn.Close()
+		defer cancel()
+		tunnelConn, err := dial(ctxConn)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("tunnel: %v", err)
+			}
+			return
+		}
+		defer tunnelConn.Close()
+		connpipe.Run(ctxConn, tunnelConn, listenerConn)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			listenerConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleListenerConn(listenerConn)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+}